@@ -1,51 +1,197 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/1llusion1st/mr.notifier/notifier"
 	"github.com/alecthomas/kong"
-	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 )
 
 type CmdGenerateConfig struct {
-	OutFile string `arg:"" name:"config-file"`
+	OutFile     string `arg:"" name:"config-file" help:"file to write, - for stdout"`
+	Import      string `name:"import" type:"existingfile" help:"csv (url,@reviewer1,@reviewer2 per line) or yaml file with projects"`
+	Interactive bool   `name:"interactive" short:"i" help:"ask for settings, the bot token is checked with getMe"`
 	notifier.Config
 }
 
 func (c *CmdGenerateConfig) Run() error {
-	err := c.ParseProjectsToAdd()
-	if err != nil {
-		return err
+	projects := make([]notifier.ProjectInfo, 0, len(c.AddProjects))
+	for _, line := range c.AddProjects {
+		if strings.TrimSpace(line) != "" {
+			projects = append(projects, notifier.ParseProject(line))
+		}
 	}
-	//if c.Telegram.AdminChatId > 0 {
-	//	c.Telegram.AdminChatId = -c.Telegram.AdminChatId
-	//}
-	if c.Telegram.ChannelChatId > 0 {
-		c.Telegram.ChannelChatId = -c.Telegram.ChannelChatId
+	var reviewers []notifier.Reviewer
+	if c.Import != "" {
+		imported, importedReviewers, err := notifier.ImportProjects(c.Import)
+		if err != nil {
+			return fmt.Errorf("can't import projects: %w", err)
+		}
+		projects = append(projects, imported...)
+		reviewers = importedReviewers
 	}
-	data, err := yaml.Marshal(c.Config)
+	if c.Interactive {
+		var err error
+		projects, err = c.wizard(bufio.NewReader(os.Stdin), os.Stderr, projects)
+		if err != nil {
+			return err
+		}
+	}
+	c.SetProjects(projects, reviewers)
+	data, err := yaml.Marshal(&c.Config)
 	if err != nil {
 		return err
 	}
-	file := c.OutFile
+	// the config is written anyway, so it can be fixed by hand
+	var check notifier.Config
+	var problems notifier.ValidationErrors
+	if errors.As(notifier.LoadConfig(data, &check), &problems) {
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", problem.Message)
+		}
+	}
 	if c.OutFile == "-" {
-		file = os.Stdout.Name()
+		_, err = os.Stdout.Write(data)
+		return err
 	}
-	return ioutil.WriteFile(file, data, 0644)
+	return ioutil.WriteFile(c.OutFile, data, 0644)
 }
 
+// wizard asks for settings missing or given by flags, prompts are written to out
+func (c *CmdGenerateConfig) wizard(in *bufio.Reader, out io.Writer, projects []notifier.ProjectInfo) ([]notifier.ProjectInfo, error) {
+	ask := func(question string, value string) (string, error) {
+		if value != "" {
+			fmt.Fprintf(out, "%s [%s]: ", question, value)
+		} else {
+			fmt.Fprintf(out, "%s: ", question)
+		}
+		line, err := in.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", fmt.Errorf("no answer for %q: %w", question, err)
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			return line, nil
+		}
+		return value, nil
+	}
+	askId := func(question string, value int64, check func(id int64) error) (int64, error) {
+		for {
+			answer, err := ask(question, strconv.FormatInt(value, 10))
+			if err != nil {
+				return 0, err
+			}
+			id, err := strconv.ParseInt(answer, 10, 64)
+			if err == nil {
+				err = check(id)
+			}
+			if err == nil {
+				return id, nil
+			}
+			fmt.Fprintf(out, "  %v\n", err)
+		}
+	}
+
+	for {
+		token, err := ask("bot token", c.Telegram.BotApi)
+		if err != nil {
+			return nil, err
+		}
+		me, err := notifier.NewBotAPI(token, c.Telegram.ApiUrl).GetMe()
+		if err != nil {
+			fmt.Fprintf(out, "  token check failed: %v\n", err)
+			continue
+		}
+		fmt.Fprintf(out, "  authorized as @%s\n", me.UserName)
+		c.Telegram.BotApi = token
+		break
+	}
+	var err error
+	c.Telegram.ChannelChatId, err = askId("channel chat id", c.Telegram.ChannelChatId, func(id int64) error {
+		if id >= 0 {
+			return errors.New("groups and channels have negative ids, e.g. -1001234567890")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.Telegram.ThreadId, err = askId("thread id (0 if the chat has no topics)", c.Telegram.ThreadId, func(id int64) error {
+		if id < 0 {
+			return errors.New("thread id must not be negative")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.Telegram.AdminChatId, err = askId("admin chat id", c.Telegram.AdminChatId, func(id int64) error {
+		if id == 0 {
+			return errors.New("admin chat id is required")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if c.WebHookPath, err = ask("webhook path", c.WebHookPath); err != nil {
+		return nil, err
+	}
+	if c.WebHookListen, err = ask("webhook listen address", c.WebHookListen); err != nil {
+		return nil, err
+	}
+
+	for _, project := range projects {
+		fmt.Fprintf(out, "project %s: %s\n", project.Project, strings.Join(project.Reviewers, ", "))
+	}
+	for {
+		line, err := ask("add project (url,@reviewer1,@reviewer2), empty to finish", "")
+		if errors.Is(err, io.EOF) || line == "" {
+			return projects, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		projects = append(projects, notifier.ParseProject(line))
+	}
+}
+
+const shutdownTimeout = 10 * time.Second
+
 type CmdRunMRNotifier struct {
 	ConfigFile      string `arg:"" name:"config-file"`
 	notifier.Config `kong:"-"`
+
+	rejectedRequests uint64
+	messages         *notifier.MessageStore
+	outbox           *notifier.Outbox
+	queue            *notifier.Queue
+	dedup            *notifier.Deduplicator
+	health           *notifier.Health
+	adminServer      *http.Server
+	bot              notifier.Messenger
 }
 
 func (c *CmdRunMRNotifier) Run() error {
@@ -56,51 +202,106 @@ func (c *CmdRunMRNotifier) Run() error {
 		return err
 	}
 	logrus.Infof("parsing config ...")
-	err = yaml.Unmarshal(sourceFile, &c.Config)
+	err = notifier.LoadConfig(sourceFile, &c.Config)
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid config %s:\n%w", c.ConfigFile, err)
+	}
+	if overridden := c.Overridden(); len(overridden) > 0 {
+		logrus.Infof("taken from environment: %s", strings.Join(overridden, ", "))
+	}
+	for _, warning := range c.Warnings(sourceFile) {
+		logrus.Warnf("config %s: %s", c.ConfigFile, warning.Error())
 	}
-	logrus.Debugf("config: %v", c)
 
-	logrus.Infof("preparing tg.bot...")
-	bot, err := tgbotapi.NewBotAPI(c.Telegram.BotApi)
+	messageStore := c.MessageStore
+	if messageStore == "" {
+		messageStore = c.ConfigFile + ".messages.yaml"
+	}
+	logrus.Infof("loading message store %s ...", messageStore)
+	c.messages, err = notifier.NewMessageStore(messageStore)
 	if err != nil {
 		return err
 	}
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
+	outbox := c.Outbox
+	if outbox == "" {
+		outbox = c.ConfigFile + ".outbox.jsonl"
+	}
+	logrus.Infof("opening outbox %s ...", outbox)
+	c.outbox, err = notifier.OpenOutbox(outbox)
+	if err != nil {
+		return err
+	}
+	if pending := c.outbox.Len(); pending > 0 {
+		logrus.Infof("%d notifications are waiting for delivery", pending)
+	}
 
-	updates, err := bot.GetUpdatesChan(u)
+	logrus.Infof("preparing tg.bot...")
+	bot := notifier.NewBotAPI(c.Telegram.BotApi, c.Telegram.ApiUrl)
+	me, err := bot.GetMe()
 	if err != nil {
 		return err
 	}
-	logrus.Debugf("updates chan: %v", updates)
-	admin := notifier.NewAdminHandler(c.ConfigFile, bot, &c.Config)
-	go admin.HandleUpdates(updates)
+	logrus.Infof("authorized as @%s", me.UserName)
+	policy := notifier.DefaultRetryPolicy
+	policy.Attempts = c.Telegram.RetryAttempts
+	limiter := notifier.NewRateLimiter(c.Telegram.ChatRateLimit)
+	// admin answers are not delayed, the admin chat is far from the group limit
+	limiter.Exempt = func(chatId int64) bool {
+		return chatId == c.AdminChat()
+	}
+	c.bot = notifier.NewRetryingMessenger(bot, policy, limiter)
+
+	updates := bot.GetUpdatesChan(0, 60)
+	admin := notifier.NewAdminHandler(c.ConfigFile, c.bot, &c.Config)
+	adminDone := make(chan struct{})
+	go func() {
+		defer close(adminDone)
+		admin.HandleUpdates(updates)
+	}()
+	worker := notifier.NewOutboxWorker(c.outbox, c.bot, c.messages, c.AdminChat)
+	go worker.Run()
 
 	/* notify admin and channel */
-	err = (&RequestSendMessageToThead{Text: "bot started", ChatId: c.Config.Telegram.AdminChatId}).Send(c.Config.Telegram.BotApi)
+	_, err = c.bot.Send(notifier.SendMessageRequest{Text: "bot started", ChatId: c.Config.Telegram.AdminChatId})
 	if err != nil {
 		logrus.Errorf("can't send start message to admin: %v", err)
 	}
-	if c.Config.Telegram.ThreadId > 0 {
-		err = (&RequestSendMessageToThead{Text: "bot started", ChatId: c.Config.Telegram.ChannelChatId, MessageThreadId: c.Config.Telegram.ThreadId}).Send(c.Config.Telegram.BotApi)
-	} else {
-		err = (&RequestSendMessageToThead{Text: "bot started", ChatId: c.Config.Telegram.ChannelChatId}).Send(c.Config.Telegram.BotApi)
-	}
+	_, err = c.bot.Send(notifier.SendMessageRequest{
+		Text:            "bot started",
+		ChatId:          c.Config.Telegram.ChannelChatId,
+		MessageThreadId: c.Config.Telegram.ThreadId,
+	})
 	if err != nil {
 		logrus.Errorf("can't send start message to channel/group(thread): %v", err)
 	}
 
+	c.dedup, err = notifier.NewDeduplicator(c.DedupWindow, c.DedupStore)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("starting webhook workers ...")
+	c.queue = notifier.NewQueue(c.WebHookWorkers, c.WebHookQueueSize)
+
 	logrus.Infof("preparing http handler...")
-	http.HandleFunc(c.WebHookPath, func(w http.ResponseWriter, r *http.Request) {
+	maxBodySize, readTimeout, writeTimeout := c.WebHookLimits()
+	mux := http.NewServeMux()
+	mux.HandleFunc(c.WebHookPath, func(w http.ResponseWriter, r *http.Request) {
 		logrus.Debugf("[%s] new request...", r.Method)
+		// labels come from the payload, so they are set only for authorized requests and limited to known values
+		event, action, project, result := "", "", "", "accepted"
+		defer func() {
+			notifier.WebhookRequests.Inc(notifier.KnownLabel(event, notifier.WebhookEvents),
+				notifier.WebhookActionLabel(action), c.ProjectLabel(project), result)
+		}()
 		if r.Method != http.MethodPost {
+			result = "method_not_allowed"
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
-		data, err := ioutil.ReadAll(r.Body)
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
 		if err != nil {
+			logrus.Warnf("can't read request body: %v", err)
+			result = "bad_request"
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
@@ -108,82 +309,754 @@ func (c *CmdRunMRNotifier) Run() error {
 		var header RequestHeader
 		err = json.Unmarshal(data, &header)
 		if err != nil {
+			result = "bad_request"
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 		logrus.Debugf("unmarshaled header: %s", header.EventType)
-		if header.EventType != "merge_request" {
-			w.WriteHeader(http.StatusOK)
+		if !c.verifyToken(r, header.Project.WebURL) {
+			result = "unauthorized"
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		event, project = header.ObjectKind, header.Project.WebURL
+		// events of one MR share the key, so they are handled in order
+		var key string
+		var job func()
+		switch header.ObjectKind {
+		case "merge_request":
+			var request MergeRequestOpened
+			err = json.Unmarshal(data, &request)
+			if err != nil {
+				logrus.Errorf("bad MR request: %v", err)
+				result = "bad_payload"
+				w.WriteHeader(http.StatusExpectationFailed)
+				return
+			}
+			action = request.ObjectAttributes.Action
+			key = notifier.MergeRequestKey(request.Project.ID, request.ObjectAttributes.Iid)
+			job = func() {
+				err := c.handleMergeRequest(&request)
+				if err != nil {
+					logrus.Errorf("can't notify about MR %s!%d: %v",
+						request.Project.WebURL, request.ObjectAttributes.Iid, err)
+				}
+			}
+		case "note":
+			var request NoteEvent
+			err = json.Unmarshal(data, &request)
+			if err != nil {
+				logrus.Errorf("bad note request: %v", err)
+				result = "bad_payload"
+				w.WriteHeader(http.StatusExpectationFailed)
+				return
+			}
+			action = request.ObjectAttributes.Action
+			if request.MergeRequest != nil {
+				key = notifier.MergeRequestKey(request.Project.ID, request.MergeRequest.Iid)
+			}
+			job = func() {
+				err := c.handleNote(&request)
+				if err != nil {
+					logrus.Errorf("can't notify about note %s: %v", request.ObjectAttributes.URL, err)
+				}
+			}
+		case "pipeline":
+			var request PipelineEvent
+			err = json.Unmarshal(data, &request)
+			if err != nil {
+				logrus.Errorf("bad pipeline request: %v", err)
+				result = "bad_payload"
+				w.WriteHeader(http.StatusExpectationFailed)
+				return
+			}
+			action = request.ObjectAttributes.Status
+			if request.MergeRequest != nil {
+				key = notifier.MergeRequestKey(request.Project.ID, request.MergeRequest.Iid)
+			}
+			job = func() {
+				err := c.handlePipeline(&request)
+				if err != nil {
+					logrus.Errorf("can't notify about pipeline %s#%d: %v",
+						request.Project.WebURL, request.ObjectAttributes.ID, err)
+				}
+			}
+		default:
+			logrus.Debugf("%s event skipped", header.ObjectKind)
+			result = "skipped"
 			return
 		}
+		delivery := deliveryKey(r, data)
+		if c.dedup.Seen(delivery) {
+			logrus.Infof("duplicate delivery of %s event of %s (event %q, webhook %q) skipped",
+				header.ObjectKind, header.Project.WebURL,
+				r.Header.Get("X-Gitlab-Event-UUID"), r.Header.Get("X-Gitlab-Webhook-UUID"))
+			result = "duplicate"
+			return
+		}
+		if !c.queue.Push(key, job) {
+			c.dedup.Forget(delivery)
+			logrus.Errorf("webhook queue is full (%d waiting), %s event of %s rejected with 503",
+				c.queue.Len(), header.ObjectKind, header.Project.WebURL)
+			result = "queue_full"
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	})
+	if c.AdminListen != "" {
+		c.health = &notifier.Health{
+			Bot:         bot,
+			Outbox:      c.outbox,
+			Queue:       c.queue,
+			ConfigPath:  c.ConfigFile,
+			UpdatesDone: adminDone,
+			Version:     versionInfo(),
+		}
+		notifier.NewGaugeFunc("mr_notifier_outbox_items", "Notifications waiting for delivery.", func() float64 {
+			return float64(c.outbox.Len())
+		})
+		notifier.NewGaugeFunc("mr_notifier_queue_events", "Webhook events waiting for workers.", func() float64 {
+			return float64(c.queue.Len())
+		})
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/", c.health.Handler())
+		adminMux.Handle("/metrics", notifier.MetricsHandler())
+		c.adminServer = &http.Server{
+			Addr:              c.AdminListen,
+			Handler:           adminMux,
+			ReadHeaderTimeout: 5 * time.Second,
+			WriteTimeout:      10 * time.Second,
+		}
+		go func() {
+			logrus.Infof("starting admin http server on %s ...", c.AdminListen)
+			if err := c.adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logrus.Errorf("admin http server failed: %v", err)
+			}
+		}()
+	}
 
-		var request MergeRequestOpened
-		err = json.Unmarshal(data, &request)
+	server := &http.Server{
+		Addr:              c.ListenAddress(),
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       time.Minute,
+	}
+	stopWatching := make(chan struct{})
+	defer close(stopWatching)
+	var reloader *notifier.TLSReloader
+	if c.TLS.Cert != "" || c.TLS.ClientCA != "" {
+		reloader, err = notifier.NewTLSReloader(c.TLS.Cert, c.TLS.Key, c.TLS.ClientCA, c.TLS.ClientName)
 		if err != nil {
-			logrus.Errorf("bad MR request: %v", err)
-			w.WriteHeader(http.StatusExpectationFailed)
+			return err
+		}
+		server.TLSConfig = reloader.TLSConfig()
+		go reloader.Watch(stopWatching)
+	}
+	watcher := notifier.NewConfigWatcher(c.ConfigFile, &c.Config, c.bot)
+	go watcher.Watch(stopWatching)
+	go reloadOnSignal(watcher, reloader, stopWatching)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	serverErr := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			logrus.Infof("starting https server on %s ...", server.Addr)
+			serverErr <- server.ListenAndServeTLS("", "")
 			return
 		}
-		if request.ObjectAttributes.State == "opened" {
-			// MR was opened
-			project := request.Project.WebURL
-			author := request.User.Email + ": " + request.User.Username + ": " + request.User.Name
-			sourceBranch := request.ObjectAttributes.SourceBranch
-			targetBranch := request.ObjectAttributes.TargetBranch
-			reviewers := c.GetProjectReviewers(project)
-			tittle := request.ObjectAttributes.Title
-			description := request.ObjectAttributes.Description
-			url := request.ObjectAttributes.URL
-
-			reviewersLinks := ""
-			if len(reviewers) > 0 {
-				reviewersLinks = strings.Join(reviewers, ", ")
+		logrus.Infof("starting http server on %s ...", server.Addr)
+		serverErr <- server.ListenAndServe()
+	}()
+	select {
+	case <-ctx.Done():
+		logrus.Infof("stopping ...")
+	case err = <-serverErr:
+		logrus.Errorf("http server failed: %v", err)
+	}
+	c.shutdown(server, bot, worker, adminDone)
+	return err
+}
+
+// reloadOnSignal reloads config and tls certificate (if used) on SIGHUP
+func reloadOnSignal(watcher *notifier.ConfigWatcher, reloader *notifier.TLSReloader, stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+			watcher.Reload()
+			if reloader == nil {
+				continue
 			}
-			message := tgbotapi.NewMessage(c.Telegram.ChannelChatId, fmt.Sprintf(`#MR
-			project: %s
-			by: %s
-			route: %s -> %s
-			link: %s
-			info: %s
-			description: %s
-			reviwers: %s
-			`,
-				project,
-				author,
-				sourceBranch, targetBranch,
-				url,
-				tittle,
-				description,
-				reviewersLinks,
-			))
-			if c.Config.Telegram.ThreadId > 0 {
-				message := RequestSendMessageToThead{
-					MessageThreadId: c.Config.Telegram.ThreadId,
-					ChatId:          message.ChatID,
-					Text:            message.Text,
-				}
-				err = message.Send(c.Telegram.BotApi)
-			} else {
-				_, err = bot.Send(message)
+			if err := reloader.Reload(); err != nil {
+				logrus.Errorf("can't reload tls certificate: %v", err)
 			}
+		}
+	}
+}
+
+// shutdown stops accepting webhooks, handles queued ones, stops telegram updates and flushes config
+func (c *CmdRunMRNotifier) shutdown(server *http.Server, bot *notifier.BotAPI, worker *notifier.OutboxWorker, adminDone <-chan struct{}) {
+	if c.health != nil {
+		c.health.SetStopping()
+	}
+	logrus.Infof("stopping http server ...")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logrus.Errorf("can't stop http server: %v", err)
+	}
+	logrus.Infof("draining webhook queue (%d waiting) ...", c.queue.Len())
+	c.queue.Close()
+	logrus.Infof("stopping telegram updates ...")
+	bot.StopReceivingUpdates()
+	<-adminDone
+	worker.Stop()
+	if pending := c.outbox.Len(); pending > 0 {
+		logrus.Infof("%d notifications will be delivered after restart", pending)
+	}
+	if err := c.outbox.Close(); err != nil {
+		logrus.Errorf("can't close outbox: %v", err)
+	}
+	logrus.Infof("flushing config ...")
+	c.Config.Flush()
+
+	_, err := c.bot.Send(notifier.SendMessageRequest{Text: "bot stopping", ChatId: c.AdminChat()})
+	if err != nil {
+		logrus.Errorf("can't send stop message to admin: %v", err)
+	}
+	if c.adminServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err = c.adminServer.Shutdown(ctx); err != nil {
+			logrus.Errorf("can't stop admin http server: %v", err)
+		}
+	}
+}
+
+// version is set on build: go build -ldflags "-X main.version=1.2.3"
+var version = "dev"
+
+func versionInfo() map[string]string {
+	info := map[string]string{"version": version}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info["go"] = build.GoVersion
+	for _, setting := range build.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info["revision"] = setting.Value
+		case "vcs.time":
+			info["time"] = setting.Value
+		case "vcs.modified":
+			info["modified"] = setting.Value
+		}
+	}
+	return info
+}
+
+// handleMergeRequest updates the MR announcement and queues its posting or editing
+func (c *CmdRunMRNotifier) handleMergeRequest(request *MergeRequestOpened) error {
+	project := request.Project.WebURL
+	action := request.ObjectAttributes.Action
+	if !c.IsProjectActionEnabled(project, action) {
+		logrus.Debugf("MR %s!%d action %q disabled", project, request.ObjectAttributes.Iid, action)
+		return nil
+	}
+	status, ok := mergeRequestStatus(request)
+	if !ok {
+		logrus.Debugf("MR %s!%d action %q skipped", project, request.ObjectAttributes.Iid, action)
+		return nil
+	}
+	data := c.mergeRequestData(request)
+	entry := ""
+	if action != notifier.ActionOpen {
+		var err error
+		entry, _, err = c.render(project, notifier.TemplateMergeRequestChange, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	projectId, iid := request.Project.ID, request.ObjectAttributes.Iid
+	chatId, threadId := c.Channel()
+	err := c.messages.Update(projectId, iid, func(record *notifier.MessageRecord, found bool) (bool, error) {
+		if !found {
+			text, _, err := c.render(project, notifier.TemplateMergeRequest, data)
 			if err != nil {
-				logrus.Errorf("can't send message: %v", err)
+				return false, err
 			}
+			*record = notifier.MessageRecord{
+				ChatId:    chatId,
+				ThreadId:  threadId,
+				Text:      text,
+				ParseMode: c.Formatter().ParseMode(),
+			}
+		}
+		// the MR may be first seen on any action (e.g. opened before the bot was deployed)
+		authorId := request.ObjectAttributes.AuthorID
+		if authorId != 0 {
+			record.AuthorId = authorId
+		}
+		if authorId != 0 && authorId == request.User.ID || authorId == 0 && action == notifier.ActionOpen {
+			record.Author = request.User.Username
+		}
+		if status != "" {
+			record.Status = status
+		}
+		if entry != "" {
+			record.AddChangelog(entry)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	return c.outbox.Add(notifier.OutboxItem{
+		Kind:      notifier.OutboxAnnounce,
+		ProjectId: projectId,
+		Iid:       iid,
+		Project:   project,
+	})
+}
+
+// handlePipeline queues a reply to the MR announcement when MR pipeline status changes
+func (c *CmdRunMRNotifier) handlePipeline(request *PipelineEvent) error {
+	if request.MergeRequest == nil || request.MergeRequest.Iid == 0 {
+		logrus.Debugf("pipeline %d is not MR pipeline, skipped", request.ObjectAttributes.ID)
+		return nil
+	}
+	status := request.ObjectAttributes.Status
+	if !c.IsPipelineStatusEnabled(status) {
+		logrus.Debugf("pipeline %d status %q skipped", request.ObjectAttributes.ID, status)
+		return nil
+	}
+
+	projectId, iid := request.Project.ID, request.MergeRequest.Iid
+	var text, parseMode string
+	err := c.messages.Update(projectId, iid, func(record *notifier.MessageRecord, found bool) (bool, error) {
+		if !found {
+			logrus.Debugf("no message for MR %s!%d, pipeline %d skipped", request.Project.WebURL, iid, request.ObjectAttributes.ID)
+			return false, nil
+		}
+		if !record.SetPipelineStatus(request.ObjectAttributes.ID, status) {
+			logrus.Debugf("pipeline %d status %q already reported", request.ObjectAttributes.ID, status)
+			return false, nil
 		}
+		var err error
+		text, parseMode, err = c.render(request.Project.WebURL, notifier.TemplatePipeline, c.pipelineData(request, record.Author, record.AuthorId))
+		return err == nil, err
+	})
+	if err != nil || text == "" {
+		return err
+	}
+	return c.outbox.Add(notifier.OutboxItem{
+		Kind:      notifier.OutboxReply,
+		ProjectId: projectId,
+		Iid:       iid,
+		Project:   request.Project.WebURL,
+		Text:      text,
+		ParseMode: parseMode,
+	})
+}
+
+// handleNote queues a reply to the MR announcement with the comment excerpt
+func (c *CmdRunMRNotifier) handleNote(request *NoteEvent) error {
+	note := &request.ObjectAttributes
+	if note.NoteableType != "MergeRequest" || request.MergeRequest == nil || note.System {
+		logrus.Debugf("note %d on %s skipped", note.ID, note.NoteableType)
+		return nil
+	}
+	if note.Action != "" && note.Action != "create" {
+		logrus.Debugf("note %d action %q skipped", note.ID, note.Action)
+		return nil
+	}
 
+	if _, found := c.messages.Get(request.Project.ID, request.MergeRequest.Iid); !found {
+		logrus.Debugf("no message for MR %s!%d, note %d skipped", request.Project.WebURL, request.MergeRequest.Iid, note.ID)
+		return nil
+	}
+
+	text, parseMode, err := c.render(request.Project.WebURL, notifier.TemplateNote, c.noteData(request))
+	if err != nil {
+		return err
+	}
+	return c.outbox.Add(notifier.OutboxItem{
+		Kind:      notifier.OutboxReply,
+		ProjectId: request.Project.ID,
+		Iid:       request.MergeRequest.Iid,
+		Project:   request.Project.WebURL,
+		Text:      text,
+		ParseMode: parseMode,
 	})
-	logrus.Infof("starting http server ...")
-	_ = http.ListenAndServe(fmt.Sprintf(":%d", c.WebHookPort), nil)
+}
+
+// render executes project template for the event, returns text and its parse mode
+func (c *CmdRunMRNotifier) render(project string, event string, data interface{}) (string, string, error) {
+	f := c.Formatter()
+	text, err := c.renderText(event, c.GetTemplate(project, event), f, data)
+	return text, f.ParseMode(), err
+}
+
+// renderText executes the template with helpers depending on config
+func (c *CmdRunMRNotifier) renderText(event string, text string, f notifier.Formatter, data interface{}) (string, error) {
+	text, err := notifier.RenderTemplate(event, text, f, template.FuncMap{
+		"labels": labelTitles,
+		"forward": func(text string) string {
+			text, mentioned := c.forwardMentions(f, text)
+			if note, ok := data.(*NoteTemplateData); ok {
+				note.forwarded(mentioned)
+			}
+			return text
+		},
+	}, data)
+	if err != nil {
+		return "", fmt.Errorf("can't render %s template: %w", event, err)
+	}
+	return text, nil
+}
+
+type MergeRequestTemplateData struct {
+	*MergeRequestOpened
+	Time      time.Time
+	Author    notifier.Reviewer
+	By        notifier.Reviewer
+	Reviewers []notifier.Reviewer
+	Assignees []notifier.Reviewer
+	// Updates lists meaningful changes of "update" action
+	Updates []string
+}
+
+type PipelineTemplateData struct {
+	*PipelineEvent
+	Link   string
+	Author notifier.Reviewer
+}
+
+type NoteTemplateData struct {
+	*NoteEvent
+	Commenter notifier.Reviewer
+	// mentioned are people of the note, forward marks those it has mentioned already
+	mentioned []notifier.Reviewer
+	usernames []string
+	done      map[string]bool
+}
+
+// CC are people mentioned in the note, but not in the text rendered so far (e.g. cut off by truncate)
+func (d *NoteTemplateData) CC() []notifier.Reviewer {
+	cc := make([]notifier.Reviewer, 0)
+	for idx, person := range d.mentioned {
+		if !d.done[d.usernames[idx]] {
+			cc = append(cc, person)
+		}
+	}
+	return cc
+}
+
+func (d *NoteTemplateData) forwarded(usernames []string) {
+	for _, username := range usernames {
+		d.done[username] = true
+	}
+}
+
+func (c *CmdRunMRNotifier) mergeRequestData(request *MergeRequestOpened) *MergeRequestTemplateData {
+	data := &MergeRequestTemplateData{
+		MergeRequestOpened: request,
+		Time:               time.Now(),
+		By:                 c.gitlabUser(request.User.Username, request.User.ID, request.User.Name),
+		Reviewers:          c.ResolveReviewers(c.GetProjectReviewers(request.Project.WebURL)),
+		Assignees:          make([]notifier.Reviewer, 0, len(request.Assignees)),
+	}
+	if request.ObjectAttributes.Action == notifier.ActionUpdate {
+		data.Updates = request.MeaningfulChanges()
+	}
+	data.Author = data.By
+	authorId := request.ObjectAttributes.AuthorID
+	if request.ObjectAttributes.Action != notifier.ActionOpen && authorId != 0 && authorId != request.User.ID {
+		// payload has only author id
+		data.Author = c.gitlabUser("", authorId, fmt.Sprintf("gitlab user #%d", authorId))
+	}
+	for _, reviewer := range request.Reviewers {
+		data.Reviewers = append(data.Reviewers, c.gitlabUser(reviewer.Username, reviewer.ID, reviewer.Name))
+	}
+	for _, assignee := range request.Assignees {
+		data.Assignees = append(data.Assignees, c.gitlabUser(assignee.Username, assignee.ID, assignee.Name))
+	}
+	return data
+}
+
+// pipelineData mentions the MR author when known, otherwise the user who triggered the pipeline
+func (c *CmdRunMRNotifier) pipelineData(request *PipelineEvent, author string, authorId int) *PipelineTemplateData {
+	data := &PipelineTemplateData{
+		PipelineEvent: request,
+		Link:          request.ObjectAttributes.URL,
+	}
+	if data.Link == "" {
+		data.Link = fmt.Sprintf("%s/-/pipelines/%d", request.Project.WebURL, request.ObjectAttributes.ID)
+	}
+	switch {
+	case author != "":
+		data.Author = c.gitlabUser(author, authorId, "")
+	case authorId != 0:
+		data.Author = c.gitlabUser("", authorId, fmt.Sprintf("gitlab user #%d", authorId))
+	default:
+		data.Author = c.gitlabUser(request.User.Username, request.User.ID, request.User.Name)
+	}
+	return data
+}
+
+func (c *CmdRunMRNotifier) noteData(request *NoteEvent) *NoteTemplateData {
+	data := &NoteTemplateData{
+		NoteEvent: request,
+		Commenter: c.gitlabUser(request.User.Username, request.User.ID, request.User.Name),
+		done:      make(map[string]bool),
+	}
+	seen := make(map[string]bool)
+	for _, match := range gitlabMention.FindAllStringSubmatch(request.ObjectAttributes.Note, -1) {
+		username := strings.TrimRight(match[2], ".-")
+		if seen[username] {
+			continue
+		}
+		seen[username] = true
+		if person, ok := c.FindGitLabUser(username, 0); ok {
+			data.mentioned = append(data.mentioned, person)
+			data.usernames = append(data.usernames, username)
+		}
+	}
+	return data
+}
+
+var gitlabMention = regexp.MustCompile(`(^|[^\w@])@([\w][\w.\-]*)`)
+
+// gitlabUser resolves gitlab user to telegram person, unknown users keep their gitlab name
+func (c *CmdRunMRNotifier) gitlabUser(username string, id int, name string) notifier.Reviewer {
+	person, ok := c.FindGitLabUser(username, id)
+	if !ok && name != "" {
+		person.DisplayName = name
+	}
+	return person
+}
+
+// forwardMentions escapes raw text replacing gitlab @username mentions with telegram mentions,
+// returns usernames of the mentioned people
+func (c *CmdRunMRNotifier) forwardMentions(f notifier.Formatter, text string) (string, []string) {
+	var b strings.Builder
+	mentioned := make([]string, 0)
+	last := 0
+	for _, match := range gitlabMention.FindAllStringSubmatchIndex(text, -1) {
+		// match[4]:match[5] is the username without @
+		start, end := match[4], match[5]
+		username := strings.TrimRight(text[start:end], ".-")
+		person, ok := c.FindGitLabUser(username, 0)
+		if !ok {
+			continue
+		}
+		b.WriteString(f.Escape(text[last : start-1]))
+		b.WriteString(f.Mention(person))
+		mentioned = append(mentioned, username)
+		last = start + len(username)
+	}
+	b.WriteString(f.Escape(text[last:]))
+	return b.String(), mentioned
+}
+
+// mergeRequestStatus returns new MR status for the event, ok is false if it's not worth announcing
+func mergeRequestStatus(request *MergeRequestOpened) (status string, ok bool) {
+	switch request.ObjectAttributes.Action {
+	case notifier.ActionOpen:
+		return notifier.StatusOpened, true
+	case notifier.ActionReopen:
+		return notifier.StatusReopened, true
+	case notifier.ActionUpdate:
+		return "", len(request.MeaningfulChanges()) > 0
+	case notifier.ActionApproved:
+		return notifier.StatusApproved, true
+	case notifier.ActionUnapproved:
+		return notifier.StatusUnapproved, true
+	case notifier.ActionMerge:
+		return notifier.StatusMerged, true
+	case notifier.ActionClose:
+		return notifier.StatusClosed, true
+	}
+	return "", false
+}
+
+// deliveryKey identifies webhook delivery by the payload hash of the webhook: retries, "Test" and "Resend"
+// repeat the payload, while the event uuid is new on every "Test" and "Resend"
+func deliveryKey(r *http.Request, data []byte) string {
+	sum := sha256.Sum256(data)
+	key := "sha256:" + hex.EncodeToString(sum[:])
+	if uuid := r.Header.Get("X-Gitlab-Webhook-UUID"); uuid != "" {
+		return "webhook:" + uuid + ":" + key
+	}
+	return key
+}
+
+func (c *CmdRunMRNotifier) verifyToken(r *http.Request, project string) bool {
+	secret, required := c.GetProjectSecret(project)
+	if !required {
+		return true
+	}
+	if secret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), []byte(secret)) == 1 {
+		return true
+	}
+	rejected := atomic.AddUint64(&c.rejectedRequests, 1)
+	if secret == "" {
+		logrus.Warnf("rejected webhook from %s: no secret configured for project %q (rejected total: %d)",
+			r.RemoteAddr, project, rejected)
+	} else {
+		logrus.Warnf("rejected webhook from %s: bad X-Gitlab-Token for project %q (rejected total: %d)",
+			r.RemoteAddr, project, rejected)
+	}
+	return false
+}
+
+type CmdValidateConfig struct {
+	ConfigFile string `arg:"" name:"config-file"`
+}
+
+func (c *CmdValidateConfig) Run() error {
+	sourceFile, err := ioutil.ReadFile(c.ConfigFile)
+	if err != nil {
+		return err
+	}
+	var config notifier.Config
+	err = notifier.LoadConfig(sourceFile, &config)
+	var problems notifier.ValidationErrors
+	if errors.As(err, &problems) {
+		for _, problem := range problems {
+			c.print(problem, "")
+		}
+		return fmt.Errorf("%s: %d problems found", c.ConfigFile, len(problems))
+	}
+	if err != nil {
+		return err
+	}
+	for _, warning := range config.Warnings(sourceFile) {
+		c.print(warning, "warning: ")
+	}
+	fmt.Printf("%s is valid\n", c.ConfigFile)
+	return nil
+}
+
+func (c *CmdValidateConfig) print(problem notifier.ValidationError, prefix string) {
+	if problem.Line > 0 {
+		fmt.Fprintf(os.Stderr, "%s:%d: %s%s\n", c.ConfigFile, problem.Line, prefix, problem.Message)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: %s%s\n", c.ConfigFile, prefix, problem.Message)
+	}
+}
+
+type CmdRenderTemplate struct {
+	Payload    string `arg:"" name:"payload" help:"gitlab webhook payload (json), e.g. mr.example.json"`
+	ConfigFile string `name:"config" short:"c" help:"config file to take templates and reviewers from"`
+	Template   string `name:"template" short:"t" help:"template file to preview instead of the configured one"`
+	Event      string `name:"event" short:"e" help:"template to render: merge_request, merge_request_change, pipeline or note (guessed from payload by default)"`
+}
+
+func (c *CmdRenderTemplate) Run() error {
+	payload, err := ioutil.ReadFile(c.Payload)
+	if err != nil {
+		return err
+	}
+	var header RequestHeader
+	err = json.Unmarshal(payload, &header)
+	if err != nil {
+		return err
+	}
+	notifierCmd := &CmdRunMRNotifier{}
+	if c.ConfigFile != "" {
+		sourceFile, err := ioutil.ReadFile(c.ConfigFile)
+		if err != nil {
+			return err
+		}
+		// loaded like run does, so environment overrides and migrations apply to the preview too
+		err = notifier.LoadConfig(sourceFile, &notifierCmd.Config)
+		if err != nil {
+			return fmt.Errorf("invalid config %s:\n%w", c.ConfigFile, err)
+		}
+	}
+
+	var data interface{}
+	event := c.Event
+	switch header.ObjectKind {
+	case "merge_request":
+		var request MergeRequestOpened
+		err = json.Unmarshal(payload, &request)
+		data = notifierCmd.mergeRequestData(&request)
+		if event == "" {
+			event = notifier.TemplateMergeRequest
+		}
+	case "pipeline":
+		var request PipelineEvent
+		err = json.Unmarshal(payload, &request)
+		data = notifierCmd.pipelineData(&request, "", 0)
+		if event == "" {
+			event = notifier.TemplatePipeline
+		}
+	case "note":
+		var request NoteEvent
+		err = json.Unmarshal(payload, &request)
+		data = notifierCmd.noteData(&request)
+		if event == "" {
+			event = notifier.TemplateNote
+		}
+	default:
+		return fmt.Errorf("unsupported payload object_kind %q", header.ObjectKind)
+	}
+	if err != nil {
+		return err
+	}
+
+	text := notifierCmd.GetTemplate(header.Project.WebURL, event)
+	if c.Template != "" {
+		source, err := ioutil.ReadFile(c.Template)
+		if err != nil {
+			return err
+		}
+		text = string(source)
+	}
+	if text == "" {
+		return fmt.Errorf("unknown template %q", event)
+	}
+	output, err := notifierCmd.renderText(event, text, notifierCmd.Formatter(), data)
+	if err != nil {
+		return err
+	}
+	fmt.Println(output)
 	return nil
 }
 
 var cli struct {
 	Generate CmdGenerateConfig `cmd:""`
 	Run      CmdRunMRNotifier  `cmd:""`
+	Render   CmdRenderTemplate `cmd:"" help:"preview message template against sample payload"`
+	Validate CmdValidateConfig `cmd:"" help:"check config file"`
 }
 
+// chatIdMapper accepts negative ids after a space: kong takes "--telegram.channel-id -100" for a short flag
+var chatIdMapper = kong.MapperFunc(func(ctx *kong.DecodeContext, target reflect.Value) error {
+	token := ctx.Scan.Pop()
+	if token.Type == kong.EOLToken {
+		return errors.New("expected int value")
+	}
+	value, err := strconv.ParseInt(token.String(), 10, 64)
+	if err != nil {
+		return fmt.Errorf("expected int value but got %q", token.String())
+	}
+	target.SetInt(value)
+	return nil
+})
+
 func main() {
-	ctx := kong.Parse(&cli)
+	ctx := kong.Parse(&cli, kong.TypeMapper(reflect.TypeOf(int64(0)), chatIdMapper))
 	// Call the Run() method of the selected parsed command.
 	err := ctx.Run()
 	ctx.FatalIfErrorf(err)
@@ -192,6 +1065,10 @@ func main() {
 type RequestHeader struct {
 	ObjectKind string `json:"object_kind"`
 	EventType  string `json:"event_type"`
+	Project    struct {
+		ID     int    `json:"id"`
+		WebURL string `json:"web_url"`
+	} `json:"project"`
 }
 
 type MergeRequestOpened struct {
@@ -244,6 +1121,7 @@ type MergeRequestOpened struct {
 		State                       string      `json:"state"`
 		BlockingDiscussionsResolved bool        `json:"blocking_discussions_resolved"`
 		WorkInProgress              bool        `json:"work_in_progress"`
+		Draft                       bool        `json:"draft"`
 		FirstContribution           bool        `json:"first_contribution"`
 		MergeStatus                 string      `json:"merge_status"`
 		TargetProjectID             int         `json:"target_project_id"`
@@ -291,33 +1169,12 @@ type MergeRequestOpened struct {
 				Email string `json:"email"`
 			} `json:"author"`
 		} `json:"last_commit"`
-		Labels []struct {
-			ID          int       `json:"id"`
-			Title       string    `json:"title"`
-			Color       string    `json:"color"`
-			ProjectID   int       `json:"project_id"`
-			CreatedAt   time.Time `json:"created_at"`
-			UpdatedAt   time.Time `json:"updated_at"`
-			Template    bool      `json:"template"`
-			Description string    `json:"description"`
-			Type        string    `json:"type"`
-			GroupID     int       `json:"group_id"`
-		} `json:"labels"`
-		Action              string `json:"action"`
-		DetailedMergeStatus string `json:"detailed_merge_status"`
+		Labels              []Label `json:"labels"`
+		Action              string  `json:"action"`
+		DetailedMergeStatus string  `json:"detailed_merge_status"`
+		Oldrev              string  `json:"oldrev"`
 	} `json:"object_attributes"`
-	Labels []struct {
-		ID          int       `json:"id"`
-		Title       string    `json:"title"`
-		Color       string    `json:"color"`
-		ProjectID   int       `json:"project_id"`
-		CreatedAt   time.Time `json:"created_at"`
-		UpdatedAt   time.Time `json:"updated_at"`
-		Template    bool      `json:"template"`
-		Description string    `json:"description"`
-		Type        string    `json:"type"`
-		GroupID     int       `json:"group_id"`
-	} `json:"labels"`
+	Labels  []Label `json:"labels"`
 	Changes struct {
 		UpdatedByID struct {
 			Previous interface{} `json:"previous"`
@@ -328,31 +1185,25 @@ type MergeRequestOpened struct {
 			Current  string `json:"current"`
 		} `json:"updated_at"`
 		Labels struct {
-			Previous []struct {
-				ID          int       `json:"id"`
-				Title       string    `json:"title"`
-				Color       string    `json:"color"`
-				ProjectID   int       `json:"project_id"`
-				CreatedAt   time.Time `json:"created_at"`
-				UpdatedAt   time.Time `json:"updated_at"`
-				Template    bool      `json:"template"`
-				Description string    `json:"description"`
-				Type        string    `json:"type"`
-				GroupID     int       `json:"group_id"`
-			} `json:"previous"`
-			Current []struct {
-				ID          int       `json:"id"`
-				Title       string    `json:"title"`
-				Color       string    `json:"color"`
-				ProjectID   int       `json:"project_id"`
-				CreatedAt   time.Time `json:"created_at"`
-				UpdatedAt   time.Time `json:"updated_at"`
-				Template    bool      `json:"template"`
-				Description string    `json:"description"`
-				Type        string    `json:"type"`
-				GroupID     int       `json:"group_id"`
-			} `json:"current"`
+			Previous []Label `json:"previous"`
+			Current  []Label `json:"current"`
 		} `json:"labels"`
+		Title struct {
+			Previous string `json:"previous"`
+			Current  string `json:"current"`
+		} `json:"title"`
+		TargetBranch struct {
+			Previous string `json:"previous"`
+			Current  string `json:"current"`
+		} `json:"target_branch"`
+		Draft struct {
+			Previous bool `json:"previous"`
+			Current  bool `json:"current"`
+		} `json:"draft"`
+		WorkInProgress struct {
+			Previous bool `json:"previous"`
+			Current  bool `json:"current"`
+		} `json:"work_in_progress"`
 	} `json:"changes"`
 	Assignees []struct {
 		ID        int    `json:"id"`
@@ -368,36 +1219,166 @@ type MergeRequestOpened struct {
 	} `json:"reviewers"`
 }
 
-type RequestSendMessageToThead struct {
-	ChatId          int64  `json:"chat_id"`
-	MessageThreadId int64  `json:"message_thread_id,omitempty"`
-	Text            string `json:"text"`
+type PipelineEvent struct {
+	ObjectKind       string `json:"object_kind"`
+	ObjectAttributes struct {
+		ID             int      `json:"id"`
+		Iid            int      `json:"iid"`
+		Ref            string   `json:"ref"`
+		Tag            bool     `json:"tag"`
+		Sha            string   `json:"sha"`
+		BeforeSha      string   `json:"before_sha"`
+		Source         string   `json:"source"`
+		Status         string   `json:"status"`
+		DetailedStatus string   `json:"detailed_status"`
+		Stages         []string `json:"stages"`
+		Duration       int      `json:"duration"`
+		QueuedDuration int      `json:"queued_duration"`
+		URL            string   `json:"url"`
+	} `json:"object_attributes"`
+	MergeRequest *struct {
+		ID                  int    `json:"id"`
+		Iid                 int    `json:"iid"`
+		Title               string `json:"title"`
+		SourceBranch        string `json:"source_branch"`
+		SourceProjectID     int    `json:"source_project_id"`
+		TargetBranch        string `json:"target_branch"`
+		TargetProjectID     int    `json:"target_project_id"`
+		State               string `json:"state"`
+		MergeStatus         string `json:"merge_status"`
+		DetailedMergeStatus string `json:"detailed_merge_status"`
+		URL                 string `json:"url"`
+	} `json:"merge_request"`
+	User struct {
+		ID        int    `json:"id"`
+		Name      string `json:"name"`
+		Username  string `json:"username"`
+		AvatarURL string `json:"avatar_url"`
+		Email     string `json:"email"`
+	} `json:"user"`
+	Project struct {
+		ID                int    `json:"id"`
+		Name              string `json:"name"`
+		WebURL            string `json:"web_url"`
+		PathWithNamespace string `json:"path_with_namespace"`
+	} `json:"project"`
+	Commit struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+		Title   string `json:"title"`
+		URL     string `json:"url"`
+	} `json:"commit"`
+	Builds []struct {
+		ID     int    `json:"id"`
+		Stage  string `json:"stage"`
+		Name   string `json:"name"`
+		Status string `json:"status"`
+	} `json:"builds"`
 }
 
-func (r *RequestSendMessageToThead) Send(key string) error {
-	logrus.Debugf("creating request from: %v", *r)
-	var buf bytes.Buffer
-	err := json.NewEncoder(&buf).Encode(r)
-	if err != nil {
-		return err
+type NoteEvent struct {
+	ObjectKind string `json:"object_kind"`
+	EventType  string `json:"event_type"`
+	User       struct {
+		ID        int    `json:"id"`
+		Name      string `json:"name"`
+		Username  string `json:"username"`
+		AvatarURL string `json:"avatar_url"`
+		Email     string `json:"email"`
+	} `json:"user"`
+	ProjectID int `json:"project_id"`
+	Project   struct {
+		ID                int    `json:"id"`
+		Name              string `json:"name"`
+		WebURL            string `json:"web_url"`
+		PathWithNamespace string `json:"path_with_namespace"`
+	} `json:"project"`
+	ObjectAttributes struct {
+		ID           int    `json:"id"`
+		Note         string `json:"note"`
+		NoteableType string `json:"noteable_type"`
+		AuthorID     int    `json:"author_id"`
+		ProjectID    int    `json:"project_id"`
+		LineCode     string `json:"line_code"`
+		CommitID     string `json:"commit_id"`
+		NoteableID   int    `json:"noteable_id"`
+		System       bool   `json:"system"`
+		Type         string `json:"type"`
+		Action       string `json:"action"`
+		URL          string `json:"url"`
+		Position     *struct {
+			BaseSha      string `json:"base_sha"`
+			StartSha     string `json:"start_sha"`
+			HeadSha      string `json:"head_sha"`
+			OldPath      string `json:"old_path"`
+			NewPath      string `json:"new_path"`
+			PositionType string `json:"position_type"`
+			OldLine      int    `json:"old_line"`
+			NewLine      int    `json:"new_line"`
+		} `json:"position"`
+	} `json:"object_attributes"`
+	MergeRequest *struct {
+		ID           int    `json:"id"`
+		Iid          int    `json:"iid"`
+		Title        string `json:"title"`
+		SourceBranch string `json:"source_branch"`
+		TargetBranch string `json:"target_branch"`
+		AuthorID     int    `json:"author_id"`
+		State        string `json:"state"`
+		URL          string `json:"url"`
+	} `json:"merge_request"`
+}
+
+type Label struct {
+	ID          int       `json:"id"`
+	Title       string    `json:"title"`
+	Color       string    `json:"color"`
+	ProjectID   int       `json:"project_id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Template    bool      `json:"template"`
+	Description string    `json:"description"`
+	Type        string    `json:"type"`
+	GroupID     int       `json:"group_id"`
+}
+
+func labelTitles(labels []Label) string {
+	titles := make([]string, len(labels))
+	for idx := range labels {
+		titles[idx] = labels[idx].Title
 	}
-	req, err := http.NewRequest(
-		http.MethodPost, fmt.Sprintf("https://api.telegram.org/bot%s/%s", key, "sendMessage"), &buf)
-	if err != nil {
-		return err
+	sort.Strings(titles)
+	return strings.Join(titles, ", ")
+}
+
+// MeaningfulChanges lists changes of "update" event worth announcing
+func (r *MergeRequestOpened) MeaningfulChanges() []string {
+	changes := make([]string, 0)
+	if previous, current := labelTitles(r.Changes.Labels.Previous), labelTitles(r.Changes.Labels.Current); previous != current {
+		changes = append(changes, fmt.Sprintf("labels: [%s] -> [%s]", previous, current))
 	}
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
+	if title := r.Changes.Title; title.Previous != title.Current {
+		changes = append(changes, fmt.Sprintf("title: %q -> %q", title.Previous, title.Current))
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		logrus.Errorf("error status-code: %d", resp.StatusCode)
-
+	if branch := r.Changes.TargetBranch; branch.Previous != branch.Current {
+		changes = append(changes, fmt.Sprintf("target branch: %s -> %s", branch.Previous, branch.Current))
 	}
-	responseData, err := ioutil.ReadAll(resp.Body)
-	logrus.Debugf("response: %s", responseData)
-	return nil
+	draft, wip := r.Changes.Draft, r.Changes.WorkInProgress
+	if draft.Previous != draft.Current || wip.Previous != wip.Current {
+		if draft.Current || wip.Current {
+			changes = append(changes, "marked as draft")
+		} else {
+			changes = append(changes, "marked as ready")
+		}
+	}
+	if r.ObjectAttributes.Oldrev != "" {
+		commit := r.ObjectAttributes.LastCommit
+		message := strings.SplitN(commit.Message, "\n", 2)[0]
+		sha := commit.ID
+		if len(sha) > 8 {
+			sha = sha[:8]
+		}
+		changes = append(changes, fmt.Sprintf("new commits: %s %s", sha, message))
+	}
+	return changes
 }
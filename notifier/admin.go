@@ -4,25 +4,40 @@ import (
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"reflect"
 	"sync"
 )
 
-func NewAdminHandler(configPath string, bot *tgbotapi.BotAPI, config *Config) *AdminHandler {
+func NewAdminHandler(configPath string, bot Messenger, config *Config) *AdminHandler {
 	config.setSyncPath(configPath)
+	config.setWriteFailHandler(func(err error) {
+		_, sendErr := bot.Send(SendMessageRequest{ChatId: config.AdminChat(), Text: err.Error()})
+		if sendErr != nil {
+			logrus.Errorf("can't notify admin: %v", sendErr)
+		}
+	})
 	return &AdminHandler{
 		Config:     config,
 		Bot:        bot,
 		ConfigPath: configPath,
 		callbacks:  make(map[string]Command),
+		inputs:     make(map[inputKey]func(message *tgbotapi.Message) Command),
 	}
 }
 
 type AdminHandler struct {
-	Bot        *tgbotapi.BotAPI
+	Bot        Messenger
 	ConfigPath string
 	Config     *Config
 	callbacks  map[string]Command
-	lock       sync.Mutex
+	// inputs wait for the next message of the user in the chat
+	inputs map[inputKey]func(message *tgbotapi.Message) Command
+	lock   sync.Mutex
+}
+
+type inputKey struct {
+	chatId int64
+	userId int64
 }
 
 func (a *AdminHandler) HandleUpdates(updatesChan tgbotapi.UpdatesChannel) {
@@ -35,45 +50,72 @@ func (a *AdminHandler) HandleUpdates(updatesChan tgbotapi.UpdatesChannel) {
 				update.CallbackQuery.From.ID, update.CallbackQuery.From.UserName,
 				update.CallbackQuery.Message.MessageID, update.CallbackQuery.Data)
 			// handle callback
-			if a.Config.UnexpectedChat(int64(update.CallbackQuery.From.ID)) {
+			message := update.CallbackQuery.Message
+			caller, ok := a.Config.Caller(int64(update.CallbackQuery.From.ID), message.Chat.ID, message.Chat.IsPrivate())
+			if !ok {
+				a.answerCallback(update.CallbackQuery.ID, "you are not an admin of this bot")
 				continue
 			}
+			a.lock.Lock()
 			callback, ok := a.callbacks[update.CallbackQuery.Data]
+			a.lock.Unlock()
 			if !ok {
 				logrus.Debugf("callback not found!")
+				a.answerCallback(update.CallbackQuery.ID, "outdated button, please request the list again")
 				continue
 			}
+			if !callback.Allowed(caller) {
+				a.answerCallback(update.CallbackQuery.ID, "not allowed for "+caller.Role)
+				a.deny(callback)
+				continue
+			}
+			a.answerCallback(update.CallbackQuery.ID, "")
 			logrus.Debugf("callback: %v", callback)
-			err = callback.Execute(a.Config, a.Bot, a, update.CallbackQuery.Message.MessageID)
+			err = a.execute(callback, caller, message.MessageID)
 			if err != nil {
 				logrus.Errorf("callback call(%v) error: %v", callback, err)
 			} else {
 				logrus.Debugf("callback executed")
 			}
+			continue
 		} else if update.Message != nil {
 			logrus.Printf("MESSAGE [%s] %s (chat: %d)", update.Message.From.UserName, update.Message.Text, update.Message.Chat.ID)
-			if a.Config.UnexpectedChat(update.Message.Chat.ID) {
+			caller, ok := a.Config.Caller(int64(update.Message.From.ID), update.Message.Chat.ID, update.Message.Chat.IsPrivate())
+			if !ok {
 				continue
 			}
-			// handle message or command
-			switch update.Message.Text {
+			// handle message or command, any message cancels waiting for input
+			next, waiting := a.takeInput(caller)
+			text := update.Message.Text
+			if update.Message.ForwardDate != 0 {
+				// forwarded messages are answers, not commands
+				text = ""
+			}
+			var command Command
+			switch text {
 			case "/start":
-				{
-					err = (&CommandStart{}).Execute(a.Config, a.Bot, a, 0)
-					break
-				}
+				command = &CommandStart{}
 			case "Projects":
-				{
-					err = (&CommandListProjects{}).Execute(a.Config, a.Bot, a, 0)
-					break
-				}
+				command = &CommandListProjects{}
 			case "Reviewers":
-				{
-					err = (&CommandListReviewers{}).Execute(a.Config, a.Bot, a, 0)
-					break
-				}
+				command = &CommandListReviewers{}
+			case "Add project", "/addproject":
+				command = &CommandAskProject{}
+			case "/backups":
+				command = &CommandListBackups{}
+			case "/cancel":
+				command = &CommandCancel{}
 			default:
-
+				if !waiting {
+					continue
+				}
+				command = next(update.Message)
+			}
+			if !command.Allowed(caller) {
+				a.deny(command)
+				_, err = a.Bot.Send(SendMessageRequest{ChatId: caller.ChatId, Text: "not allowed for " + caller.Role})
+			} else {
+				err = a.execute(command, caller, 0)
 			}
 		}
 		if err != nil {
@@ -82,6 +124,48 @@ func (a *AdminHandler) HandleUpdates(updatesChan tgbotapi.UpdatesChannel) {
 	}
 }
 
+func commandName(command Command) string {
+	return reflect.Indirect(reflect.ValueOf(command)).Type().Name()
+}
+
+func (a *AdminHandler) deny(command Command) {
+	AdminCommands.Inc(commandName(command), "denied")
+}
+
+// execute runs the command counting it in metrics
+func (a *AdminHandler) execute(command Command, caller *Caller, sourceMsgId int) error {
+	err := command.Execute(a.Config, a.Bot, a, caller, sourceMsgId)
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	AdminCommands.Inc(commandName(command), result)
+	return err
+}
+
+func (a *AdminHandler) answerCallback(callbackQueryId string, text string) {
+	err := a.Bot.AnswerCallback(callbackQueryId, text)
+	if err != nil {
+		logrus.Errorf("can't answer callback %s: %v", callbackQueryId, err)
+	}
+}
+
+// ExpectInput makes the next message of the caller a command built by next
+func (a *AdminHandler) ExpectInput(caller *Caller, next func(message *tgbotapi.Message) Command) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.inputs[inputKey{chatId: caller.ChatId, userId: caller.UserId}] = next
+}
+
+func (a *AdminHandler) takeInput(caller *Caller) (func(message *tgbotapi.Message) Command, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	key := inputKey{chatId: caller.ChatId, userId: caller.UserId}
+	next, ok := a.inputs[key]
+	delete(a.inputs, key)
+	return next, ok
+}
+
 func (a *AdminHandler) NewCallbackButton(text string, command Command) tgbotapi.InlineKeyboardButton {
 	callbackId := uuid.New()
 	a.lock.Lock()
@@ -4,40 +4,69 @@ import (
 	"fmt"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/sirupsen/logrus"
+	"net/url"
+	"regexp"
 	"strings"
 )
 
 type Command interface {
-	Execute(c *Config, bot *tgbotapi.BotAPI, admin *AdminHandler, sourceMsgId int) error
+	// Allowed checks the caller's role before Execute
+	Allowed(caller *Caller) bool
+	Execute(c *Config, bot Messenger, admin *AdminHandler, caller *Caller, sourceMsgId int) error
 }
 
 type CommandStart struct{}
 
-func (cmd *CommandStart) Execute(c *Config, bot *tgbotapi.BotAPI, admin *AdminHandler, sourceMsgId int) error {
-	reply := tgbotapi.NewMessage(c.Telegram.AdminChatId, "wellcome to MR.notifier bot!")
-	reply.ReplyMarkup = tgbotapi.NewReplyKeyboard(
-		tgbotapi.NewKeyboardButtonRow(
-			tgbotapi.NewKeyboardButton("Projects"),
-			tgbotapi.NewKeyboardButton("Reviewers"),
-		),
+func (cmd *CommandStart) Allowed(caller *Caller) bool {
+	return true
+}
+
+func (cmd *CommandStart) Execute(c *Config, bot Messenger, admin *AdminHandler, caller *Caller, sourceMsgId int) error {
+	reply := SendMessageRequest{ChatId: caller.ChatId, Text: "wellcome to MR.notifier bot!"}
+	buttons := tgbotapi.NewKeyboardButtonRow(
+		tgbotapi.NewKeyboardButton("Projects"),
+		tgbotapi.NewKeyboardButton("Reviewers"),
 	)
+	if caller.IsOwner() {
+		buttons = append(buttons, tgbotapi.NewKeyboardButton("Add project"))
+	}
+	reply.ReplyMarkup = tgbotapi.NewReplyKeyboard(buttons)
 	_, err := bot.Send(reply)
 	return err
 }
 
 type CommandListProjects struct{}
 
-func (cmd *CommandListProjects) Execute(c *Config, bot *tgbotapi.BotAPI, admin *AdminHandler, sourceMsgId int) error {
+func (cmd *CommandListProjects) Allowed(caller *Caller) bool {
+	return true
+}
+
+func (cmd *CommandListProjects) Execute(c *Config, bot Messenger, admin *AdminHandler, caller *Caller, sourceMsgId int) error {
 	logrus.Debugf("CommandListProjects Execute called with %d", sourceMsgId)
 	projects := c.ListProjects()
 	reviewers := c.ListReviewers()
 	logrus.Debugf("projects: %v reviewers: %v", projects, reviewers)
 	for _, project := range projects {
 		logrus.Debugf("processing project %s", project)
+		if !caller.CanEditProject(project) {
+			_, err := bot.Send(SendMessageRequest{
+				ChatId: caller.ChatId,
+				Text:   fmt.Sprintf("%s\n%s", project, strings.Join(c.GetProjectReviewers(project), ", ")),
+			})
+			if err != nil {
+				logrus.Errorf("can't send message: %v", err)
+			}
+			continue
+		}
 
 		markup := NewInlineMarkUp(3)
-		//markup.AddButton(admin.NewCallbackButton("REMOVE PRJ ?", nil))
-		//markup.AddRow()
+		if caller.IsOwner() {
+			markup.AddButton(admin.NewCallbackButton("rename", &CommandAskRename{Project: project}))
+			markup.AddButton(admin.NewCallbackButton("remove", &CommandConfirmRemoveProject{Project: project}))
+			if len(reviewers) > 0 {
+				markup.AddRow()
+			}
+		}
 
 		for _, reviewer := range reviewers {
 			if c.HasProjectReviewer(project, reviewer) {
@@ -61,7 +90,7 @@ func (cmd *CommandListProjects) Execute(c *Config, bot *tgbotapi.BotAPI, admin *
 			}
 		}
 
-		msg := tgbotapi.NewMessage(c.Telegram.AdminChatId, project)
+		msg := SendMessageRequest{ChatId: caller.ChatId, Text: project}
 		msg.ReplyMarkup = tgbotapi.InlineKeyboardMarkup{
 			InlineKeyboard: markup.markup,
 		}
@@ -69,10 +98,10 @@ func (cmd *CommandListProjects) Execute(c *Config, bot *tgbotapi.BotAPI, admin *
 		logrus.Debugf("sourceMsgId: %d", sourceMsgId)
 		if sourceMsgId == 0 {
 		} else {
-			logrus.Debugf("deleting %d:%d", c.Telegram.AdminChatId, sourceMsgId)
-			_, err := bot.DeleteMessage(tgbotapi.NewDeleteMessage(c.Telegram.AdminChatId, sourceMsgId))
+			logrus.Debugf("deleting %d:%d", caller.ChatId, sourceMsgId)
+			err := bot.Delete(caller.ChatId, sourceMsgId)
 			if err != nil {
-				logrus.Errorf("can't delete message(%d:%d): %v", c.Telegram.AdminChatId, sourceMsgId, err)
+				logrus.Errorf("can't delete message(%d:%d): %v", caller.ChatId, sourceMsgId, err)
 			}
 			logrus.Debugf("deleted ?")
 		}
@@ -89,9 +118,35 @@ type CommandListReviewers struct {
 	Project string
 }
 
-func (cmd *CommandListReviewers) Execute(c *Config, bot *tgbotapi.BotAPI, admin *AdminHandler, sourceMsgId int) error {
-	reviewers := c.ListReviewers()
-	msg := tgbotapi.NewMessage(c.Telegram.AdminChatId, fmt.Sprintf("Reviewers:\n%s", strings.Join(reviewers, "\n")))
+func (cmd *CommandListReviewers) Allowed(caller *Caller) bool {
+	return true
+}
+
+func (cmd *CommandListReviewers) Execute(c *Config, bot Messenger, admin *AdminHandler, caller *Caller, sourceMsgId int) error {
+	f := c.Formatter()
+	reviewers := c.ResolveReviewers(c.ListReviewers())
+	lines := make([]string, len(reviewers))
+	for idx := range reviewers {
+		lines[idx] = f.Mention(reviewers[idx])
+	}
+	msg := SendMessageRequest{
+		ChatId:    caller.ChatId,
+		Text:      f.Fit(fmt.Sprintf("%s\n%s", f.Bold("Reviewers:"), strings.Join(lines, "\n")), MaxMessageLength),
+		ParseMode: f.ParseMode(),
+	}
+	if caller.IsOwner() {
+		markup := NewInlineMarkUp(3)
+		for _, reviewer := range reviewers {
+			markup.AddButton(admin.NewCallbackButton(
+				fmt.Sprintf("- %s", reviewer.Key()),
+				&CommandConfirmRemoveReviewer{Reviewer: reviewer.Key()}))
+		}
+		markup.AddRow()
+		markup.AddButton(admin.NewCallbackButton("+ add reviewer", &CommandAskReviewer{}))
+		msg.ReplyMarkup = tgbotapi.InlineKeyboardMarkup{
+			InlineKeyboard: markup.markup,
+		}
+	}
 	_, err := bot.Send(msg)
 	return err
 }
@@ -102,14 +157,18 @@ type CommandAddProjectReviewer struct {
 	OnSuccessCallback Command
 }
 
-func (cmd *CommandAddProjectReviewer) Execute(c *Config, bot *tgbotapi.BotAPI, admin *AdminHandler, sourceMsgId int) error {
+func (cmd *CommandAddProjectReviewer) Allowed(caller *Caller) bool {
+	return caller.CanEditProject(cmd.Project)
+}
+
+func (cmd *CommandAddProjectReviewer) Execute(c *Config, bot Messenger, admin *AdminHandler, caller *Caller, sourceMsgId int) error {
 	logrus.Debugf("CommandAddProjectReviewer.Execute called")
 	added := c.AddReviewerToProject(cmd.Project, cmd.Reviewer)
 	logrus.Debugf("Added %s to %s ? %v", cmd.Reviewer, cmd.Project, added)
 	logrus.Debugf("checking cmd.OnSuccessCallback: %v", cmd.OnSuccessCallback)
 	if cmd.OnSuccessCallback != nil {
 		logrus.Debugf("calling callback-2")
-		return cmd.OnSuccessCallback.Execute(c, bot, admin, sourceMsgId)
+		return cmd.OnSuccessCallback.Execute(c, bot, admin, caller, sourceMsgId)
 	}
 	return nil
 }
@@ -120,14 +179,334 @@ type CommandRemoveProjectReviewer struct {
 	OnSuccessCallback Command
 }
 
-func (cmd *CommandRemoveProjectReviewer) Execute(c *Config, bot *tgbotapi.BotAPI, admin *AdminHandler, sourceMsgId int) error {
+func (cmd *CommandRemoveProjectReviewer) Allowed(caller *Caller) bool {
+	return caller.CanEditProject(cmd.Project)
+}
+
+func (cmd *CommandRemoveProjectReviewer) Execute(c *Config, bot Messenger, admin *AdminHandler, caller *Caller, sourceMsgId int) error {
 	logrus.Debugf("CommandRemoveProjectReviewer.Execute called")
 	removed := c.RemoveReviewerFromProject(cmd.Project, cmd.Reviewer)
 	logrus.Debugf("Removed %s from %s ? %v", cmd.Reviewer, cmd.Project, removed)
 	logrus.Debugf("checking cmd.OnSuccessCallback: %v", cmd.OnSuccessCallback)
 	if cmd.OnSuccessCallback != nil {
 		logrus.Debugf("calling callback-2")
-		return cmd.OnSuccessCallback.Execute(c, bot, admin, sourceMsgId)
+		return cmd.OnSuccessCallback.Execute(c, bot, admin, caller, sourceMsgId)
 	}
 	return nil
 }
+
+type CommandListBackups struct{}
+
+func (cmd *CommandListBackups) Allowed(caller *Caller) bool {
+	return caller.IsOwner()
+}
+
+func (cmd *CommandListBackups) Execute(c *Config, bot Messenger, admin *AdminHandler, caller *Caller, sourceMsgId int) error {
+	backups, err := ListBackups(admin.ConfigPath)
+	if err != nil {
+		return err
+	}
+	msg := SendMessageRequest{ChatId: caller.ChatId, Text: "no config backups yet"}
+	if len(backups) > 0 {
+		msg.Text = "config backups, press to restore:"
+		markup := NewInlineMarkUp(1)
+		for _, backup := range backups {
+			markup.AddButton(admin.NewCallbackButton(
+				BackupTime(backup).Format("2006-01-02 15:04:05"),
+				&CommandRestoreBackup{Backup: backup}))
+		}
+		msg.ReplyMarkup = tgbotapi.InlineKeyboardMarkup{
+			InlineKeyboard: markup.markup,
+		}
+	}
+	_, err = bot.Send(msg)
+	return err
+}
+
+type CommandRestoreBackup struct {
+	Backup string
+}
+
+func (cmd *CommandRestoreBackup) Allowed(caller *Caller) bool {
+	return caller.IsOwner()
+}
+
+func (cmd *CommandRestoreBackup) Execute(c *Config, bot Messenger, admin *AdminHandler, caller *Caller, sourceMsgId int) error {
+	changes, err := c.Restore(cmd.Backup)
+	text := fmt.Sprintf("config restored from %s", BackupTime(cmd.Backup).Format("2006-01-02 15:04:05"))
+	switch {
+	case err != nil && changes != nil:
+		text += fmt.Sprintf(" but not written: %v", err)
+	case err != nil:
+		text = fmt.Sprintf("can't restore config: %v", err)
+	case len(changes) == 0:
+		text += ", nothing changed"
+	default:
+		text += ":\n- " + strings.Join(changes, "\n- ")
+	}
+	_, sendErr := bot.Send(SendMessageRequest{ChatId: caller.ChatId, Text: text})
+	if err != nil {
+		return err
+	}
+	return sendErr
+}
+
+var telegramUsername = regexp.MustCompile(`^@[A-Za-z][A-Za-z0-9_]{4,31}$`)
+
+// ParseProjectURL checks url of the gitlab project sent to the admin chat
+func ParseProjectURL(text string) (string, error) {
+	project := strings.TrimSuffix(strings.TrimRight(strings.TrimSpace(text), "/"), ".git")
+	parsed, err := url.Parse(project)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || strings.Trim(parsed.Path, "/") == "" {
+		return "", fmt.Errorf("%q is not a gitlab project url like https://gitlab.example.com/group/project", strings.TrimSpace(text))
+	}
+	return project, nil
+}
+
+func sendText(bot Messenger, caller *Caller, text string) error {
+	_, err := bot.Send(SendMessageRequest{ChatId: caller.ChatId, Text: text})
+	return err
+}
+
+type CommandCancel struct{}
+
+func (cmd *CommandCancel) Allowed(caller *Caller) bool {
+	return true
+}
+
+func (cmd *CommandCancel) Execute(c *Config, bot Messenger, admin *AdminHandler, caller *Caller, sourceMsgId int) error {
+	if sourceMsgId != 0 {
+		if err := bot.Delete(caller.ChatId, sourceMsgId); err != nil {
+			logrus.Errorf("can't delete message(%d:%d): %v", caller.ChatId, sourceMsgId, err)
+		}
+	}
+	return sendText(bot, caller, "cancelled")
+}
+
+type CommandAskProject struct{}
+
+func (cmd *CommandAskProject) Allowed(caller *Caller) bool {
+	return caller.IsOwner()
+}
+
+func (cmd *CommandAskProject) Execute(c *Config, bot Messenger, admin *AdminHandler, caller *Caller, sourceMsgId int) error {
+	admin.ExpectInput(caller, func(message *tgbotapi.Message) Command {
+		return &CommandAddProject{Project: message.Text}
+	})
+	return sendText(bot, caller, "send url of the gitlab project, e.g. https://gitlab.example.com/group/project, or /cancel")
+}
+
+type CommandAddProject struct {
+	Project string
+}
+
+func (cmd *CommandAddProject) Allowed(caller *Caller) bool {
+	return caller.IsOwner()
+}
+
+func (cmd *CommandAddProject) Execute(c *Config, bot Messenger, admin *AdminHandler, caller *Caller, sourceMsgId int) error {
+	project, err := ParseProjectURL(cmd.Project)
+	if err != nil {
+		// ask again
+		admin.ExpectInput(caller, func(message *tgbotapi.Message) Command {
+			return &CommandAddProject{Project: message.Text}
+		})
+		return sendText(bot, caller, err.Error()+", send another one or /cancel")
+	}
+	if !c.AddProject(project) {
+		return sendText(bot, caller, fmt.Sprintf("project %s already exists", project))
+	}
+	logrus.Infof("project %s added by %d", project, caller.UserId)
+	return sendText(bot, caller, fmt.Sprintf("project %s added, press Projects to choose its reviewers", project))
+}
+
+type CommandConfirmRemoveProject struct {
+	Project string
+}
+
+func (cmd *CommandConfirmRemoveProject) Allowed(caller *Caller) bool {
+	return caller.IsOwner()
+}
+
+func (cmd *CommandConfirmRemoveProject) Execute(c *Config, bot Messenger, admin *AdminHandler, caller *Caller, sourceMsgId int) error {
+	markup := NewInlineMarkUp(2)
+	markup.AddButton(admin.NewCallbackButton("yes, remove", &CommandRemoveProject{Project: cmd.Project}))
+	markup.AddButton(admin.NewCallbackButton("no", &CommandCancel{}))
+	msg := SendMessageRequest{
+		ChatId: caller.ChatId,
+		Text:   fmt.Sprintf("remove %s with its reviewers? its MRs won't be posted anymore", cmd.Project),
+	}
+	msg.ReplyMarkup = tgbotapi.InlineKeyboardMarkup{
+		InlineKeyboard: markup.markup,
+	}
+	_, err := bot.Send(msg)
+	return err
+}
+
+type CommandRemoveProject struct {
+	Project string
+}
+
+func (cmd *CommandRemoveProject) Allowed(caller *Caller) bool {
+	return caller.IsOwner()
+}
+
+func (cmd *CommandRemoveProject) Execute(c *Config, bot Messenger, admin *AdminHandler, caller *Caller, sourceMsgId int) error {
+	if sourceMsgId != 0 {
+		if err := bot.Delete(caller.ChatId, sourceMsgId); err != nil {
+			logrus.Errorf("can't delete message(%d:%d): %v", caller.ChatId, sourceMsgId, err)
+		}
+	}
+	if !c.RemoveProject(cmd.Project) {
+		return sendText(bot, caller, fmt.Sprintf("project %s is not found", cmd.Project))
+	}
+	logrus.Infof("project %s removed by %d", cmd.Project, caller.UserId)
+	return sendText(bot, caller, fmt.Sprintf("project %s removed", cmd.Project))
+}
+
+type CommandAskRename struct {
+	Project string
+}
+
+func (cmd *CommandAskRename) Allowed(caller *Caller) bool {
+	return caller.IsOwner()
+}
+
+func (cmd *CommandAskRename) Execute(c *Config, bot Messenger, admin *AdminHandler, caller *Caller, sourceMsgId int) error {
+	project := cmd.Project
+	admin.ExpectInput(caller, func(message *tgbotapi.Message) Command {
+		return &CommandRenameProject{Project: project, NewProject: message.Text}
+	})
+	return sendText(bot, caller, fmt.Sprintf("send new url of %s (after the project is renamed or moved in gitlab), or /cancel", project))
+}
+
+type CommandRenameProject struct {
+	Project    string
+	NewProject string
+}
+
+func (cmd *CommandRenameProject) Allowed(caller *Caller) bool {
+	return caller.IsOwner()
+}
+
+func (cmd *CommandRenameProject) Execute(c *Config, bot Messenger, admin *AdminHandler, caller *Caller, sourceMsgId int) error {
+	newProject, err := ParseProjectURL(cmd.NewProject)
+	if err != nil {
+		admin.ExpectInput(caller, func(message *tgbotapi.Message) Command {
+			return &CommandRenameProject{Project: cmd.Project, NewProject: message.Text}
+		})
+		return sendText(bot, caller, err.Error()+", send another one or /cancel")
+	}
+	if !c.RenameProject(cmd.Project, newProject) {
+		return sendText(bot, caller, fmt.Sprintf("can't rename %s: it is not found or %s already exists", cmd.Project, newProject))
+	}
+	logrus.Infof("project %s renamed to %s by %d", cmd.Project, newProject, caller.UserId)
+	return sendText(bot, caller, fmt.Sprintf("project %s renamed to %s", cmd.Project, newProject))
+}
+
+type CommandAskReviewer struct{}
+
+func (cmd *CommandAskReviewer) Allowed(caller *Caller) bool {
+	return caller.IsOwner()
+}
+
+func (cmd *CommandAskReviewer) Execute(c *Config, bot Messenger, admin *AdminHandler, caller *Caller, sourceMsgId int) error {
+	expectReviewer(admin, caller)
+	return sendText(bot, caller, "send @username of the reviewer or forward any message of the person, or /cancel")
+}
+
+func expectReviewer(admin *AdminHandler, caller *Caller) {
+	admin.ExpectInput(caller, func(message *tgbotapi.Message) Command {
+		return &CommandAddReviewer{
+			Text:      message.Text,
+			From:      message.ForwardFrom,
+			Forwarded: message.ForwardDate != 0,
+		}
+	})
+}
+
+type CommandAddReviewer struct {
+	Text string
+	// From is the author of the forwarded message, nil if the author hides the account
+	From      *tgbotapi.User
+	Forwarded bool
+}
+
+func (cmd *CommandAddReviewer) Allowed(caller *Caller) bool {
+	return caller.IsOwner()
+}
+
+func (cmd *CommandAddReviewer) Execute(c *Config, bot Messenger, admin *AdminHandler, caller *Caller, sourceMsgId int) error {
+	var reviewer Reviewer
+	switch {
+	case cmd.From != nil:
+		reviewer = Reviewer{
+			TelegramUsername: cmd.From.UserName,
+			TelegramUserId:   int64(cmd.From.ID),
+			DisplayName:      strings.TrimSpace(cmd.From.FirstName + " " + cmd.From.LastName),
+		}
+	case cmd.Forwarded:
+		expectReviewer(admin, caller)
+		return sendText(bot, caller, "the person hides the account in forwarded messages, send their @username instead or /cancel")
+	case telegramUsername.MatchString(strings.TrimSpace(cmd.Text)):
+		reviewer = ParseReviewer(cmd.Text)
+	default:
+		expectReviewer(admin, caller)
+		return sendText(bot, caller, fmt.Sprintf("%q is not a telegram @username, send another one or /cancel", cmd.Text))
+	}
+	key, added := c.SaveReviewer(reviewer)
+	if !added {
+		return sendText(bot, caller, fmt.Sprintf("%s is a reviewer already", key))
+	}
+	logrus.Infof("reviewer %s added by %d", key, caller.UserId)
+	return sendText(bot, caller, fmt.Sprintf("reviewer %s added, press Projects to assign them", key))
+}
+
+type CommandConfirmRemoveReviewer struct {
+	Reviewer string
+}
+
+func (cmd *CommandConfirmRemoveReviewer) Allowed(caller *Caller) bool {
+	return caller.IsOwner()
+}
+
+func (cmd *CommandConfirmRemoveReviewer) Execute(c *Config, bot Messenger, admin *AdminHandler, caller *Caller, sourceMsgId int) error {
+	text := fmt.Sprintf("remove reviewer %s? they are not assigned to any project", cmd.Reviewer)
+	if projects := c.ReviewerProjects(cmd.Reviewer); len(projects) > 0 {
+		text = fmt.Sprintf("remove reviewer %s? they will be removed from:\n%s", cmd.Reviewer, strings.Join(projects, "\n"))
+	}
+	markup := NewInlineMarkUp(2)
+	markup.AddButton(admin.NewCallbackButton("yes, remove", &CommandRemoveReviewer{Reviewer: cmd.Reviewer}))
+	markup.AddButton(admin.NewCallbackButton("no", &CommandCancel{}))
+	msg := SendMessageRequest{ChatId: caller.ChatId, Text: text}
+	msg.ReplyMarkup = tgbotapi.InlineKeyboardMarkup{
+		InlineKeyboard: markup.markup,
+	}
+	_, err := bot.Send(msg)
+	return err
+}
+
+type CommandRemoveReviewer struct {
+	Reviewer string
+}
+
+func (cmd *CommandRemoveReviewer) Allowed(caller *Caller) bool {
+	return caller.IsOwner()
+}
+
+func (cmd *CommandRemoveReviewer) Execute(c *Config, bot Messenger, admin *AdminHandler, caller *Caller, sourceMsgId int) error {
+	if sourceMsgId != 0 {
+		if err := bot.Delete(caller.ChatId, sourceMsgId); err != nil {
+			logrus.Errorf("can't delete message(%d:%d): %v", caller.ChatId, sourceMsgId, err)
+		}
+	}
+	projects := c.ReviewerProjects(cmd.Reviewer)
+	if !c.RemoveReviewer(cmd.Reviewer) {
+		return sendText(bot, caller, fmt.Sprintf("reviewer %s is not found", cmd.Reviewer))
+	}
+	logrus.Infof("reviewer %s removed by %d", cmd.Reviewer, caller.UserId)
+	if len(projects) == 0 {
+		return sendText(bot, caller, fmt.Sprintf("reviewer %s removed", cmd.Reviewer))
+	}
+	return sendText(bot, caller, fmt.Sprintf("reviewer %s removed, also from:\n%s", cmd.Reviewer, strings.Join(projects, "\n")))
+}
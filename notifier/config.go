@@ -1,16 +1,60 @@
 package notifier
 
 import (
+	"crypto/sha256"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
-	"io/ioutil"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+)
+
+const (
+	ActionOpen       = "open"
+	ActionReopen     = "reopen"
+	ActionUpdate     = "update"
+	ActionApproved   = "approved"
+	ActionUnapproved = "unapproved"
+	ActionMerge      = "merge"
+	ActionClose      = "close"
+)
+
+// DefaultActions are posted for projects without explicit actions list
+var DefaultActions = []string{
+	ActionOpen, ActionReopen, ActionUpdate, ActionApproved, ActionUnapproved, ActionMerge, ActionClose,
+}
+
+var DefaultPipelineStatuses = []string{"success", "failed", "canceled"}
+
+const (
+	DefaultWebHookMaxBodySize = 5 << 20
+	DefaultWebHookTimeout     = 10 * time.Second
 )
 
 type ProjectInfo struct {
 	Project   string   `arg:"" name:"project"`
 	Reviewers []string `arg:"" name:"reviewer"`
+	Secret    string   `kong:"-" yaml:"secret,omitempty"`
+	Actions   []string `kong:"-" yaml:"actions,omitempty"`
+	// Templates override global templates for the project
+	Templates map[string]string `kong:"-" yaml:"templates,omitempty"`
+}
+
+func hasAction(actions []string, action string) bool {
+	for _, present := range actions {
+		if present == action {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ProjectInfo) HasAction(action string) bool {
+	if len(p.Actions) == 0 {
+		return hasAction(DefaultActions, action)
+	}
+	return hasAction(p.Actions, action)
 }
 
 func (p *ProjectInfo) HasReviewer(reviewer string) bool {
@@ -38,46 +82,115 @@ func (p *ProjectInfo) RemoveReviewer(reviewerToRemove string) {
 
 type Config struct {
 	Telegram struct {
-		BotApi        string `arg:"" name:"bot-api" yaml:"bot-api"`
-		ChannelChatId int64  `arg:"" name:"channel-id" yaml:"channel-chat-id"`
-		ThreadId      int64  `arg:"" name:"thread-id" yaml:"thread-id"`
-		AdminChatId   int64  `arg:"" name:"admin-id" yaml:"admin-chat-id"`
+		BotApi        string `name:"bot-api" yaml:"bot-api" help:"bot token from @BotFather"`
+		ChannelChatId int64  `name:"channel-id" yaml:"channel-chat-id" help:"chat to post merge requests to, groups and channels have negative ids"`
+		ThreadId      int64  `name:"thread-id" yaml:"thread-id" help:"forum topic of the channel chat, 0 if none"`
+		AdminChatId   int64  `name:"admin-id" yaml:"admin-chat-id" help:"chat to manage reviewers from"`
+		ApiUrl        string `name:"api-url" yaml:"api-url,omitempty" help:"Bot API server url, https://api.telegram.org by default"`
+		ParseMode     string `name:"parse-mode" yaml:"parse-mode,omitempty" enum:"HTML,MarkdownV2," default:"" help:"HTML (default) or MarkdownV2"`
+		RetryAttempts int    `name:"retry-attempts" yaml:"retry-attempts,omitempty" help:"attempts to deliver a message, 5 by default"`
+		ChatRateLimit int    `name:"chat-rate-limit" yaml:"chat-rate-limit,omitempty" help:"max messages per minute to one chat, 20 by default"`
 	} `embed:"" prefix:"telegram."`
 	Projects    []ProjectInfo `kong:"-"`
-	Reviewers   []string      `kong:"-"`
-	WebHookPath string        `arg:"" name:"web-hook-path" yaml:"web-hook-path"`
-	WebHookPort int           `arg:"" name:"webhook-port" yaml:"web-hook-port"`
+	Reviewers   []Reviewer    `kong:"-"`
+	WebHookPath string        `name:"web-hook-path" yaml:"web-hook-path" default:"/webhook" help:"url path of the gitlab webhook"`
+	// WebHookListen is [host]:port, plain port is accepted too
+	WebHookListen string `name:"web-hook-listen" yaml:"web-hook-listen,omitempty" default:":7777" help:"[host]:port to listen for webhooks on"`
+	// WebHookPort is replaced by WebHookListen, read from old configs only
+	WebHookPort int `kong:"-" yaml:"web-hook-port,omitempty"`
+	TLS         struct {
+		Cert string `name:"cert" yaml:"cert,omitempty" help:"certificate file to serve webhooks over https"`
+		Key  string `name:"key" yaml:"key,omitempty" help:"private key file of the certificate"`
+		// ClientCA enables mTLS: webhook senders must present certificate signed by the CA
+		ClientCA   string `name:"client-ca" yaml:"client-ca,omitempty" help:"CA file to verify client certificates (mTLS)"`
+		ClientName string `name:"client-name" yaml:"client-name,omitempty" help:"required client certificate name, e.g. gitlab host"`
+	} `embed:"" prefix:"tls." yaml:"tls,omitempty"`
+	// AdminListen serves /healthz, /readyz and /version, disabled if empty
+	AdminListen string `name:"admin-listen" yaml:"admin-listen,omitempty" help:"address of health, readiness and version endpoints"`
+	// WebHookSecret is used for projects without their own secret
+	WebHookSecret string `name:"web-hook-secret" yaml:"web-hook-secret,omitempty" help:"expected X-Gitlab-Token for projects without own secret"`
+	// WebHookWorkers handle queued webhook events, events of one MR are handled by the same worker
+	WebHookWorkers   int `name:"web-hook-workers" yaml:"web-hook-workers,omitempty" help:"webhook workers, 4 by default"`
+	WebHookQueueSize int `name:"web-hook-queue-size" yaml:"web-hook-queue-size,omitempty" help:"webhook events waiting for workers, 100 by default; 503 when full"`
+	// WebHookMaxBodySize and timeouts limit webhook requests, defaults are used if not set
+	WebHookMaxBodySize  int64         `name:"web-hook-max-body-size" yaml:"web-hook-max-body-size,omitempty" help:"max webhook request body in bytes, 5MB by default"`
+	WebHookReadTimeout  time.Duration `name:"web-hook-read-timeout" yaml:"web-hook-read-timeout,omitempty" help:"time to read a webhook request, 10s by default"`
+	WebHookWriteTimeout time.Duration `name:"web-hook-write-timeout" yaml:"web-hook-write-timeout,omitempty" help:"time to handle a webhook request and write the answer, 10s by default"`
+	// DedupWindow is how long repeated webhook deliveries are skipped
+	DedupWindow time.Duration `name:"dedup-window" yaml:"dedup-window,omitempty" help:"skip repeated webhook deliveries within the window, 1h by default"`
+	DedupStore  string        `name:"dedup-store" yaml:"dedup-store,omitempty" help:"file to remember webhook deliveries in, kept in memory if empty"`
+	// Admins manage the bot by roles, everybody in the admin chat is an owner if empty
+	Admins []Admin `kong:"-" yaml:"admins,omitempty"`
+	// Users maps gitlab usernames to telegram handles
+	Users map[string]string `kong:"-" yaml:"users,omitempty"`
+	// Templates override DefaultTemplates, keys are event types: merge_request, merge_request_change, pipeline, note
+	Templates map[string]string `kong:"-" yaml:"templates,omitempty"`
+	// PipelineStatuses to report, DefaultPipelineStatuses if empty
+	PipelineStatuses []string `kong:"-" yaml:"pipeline-statuses,omitempty"`
+	// MessageStore keeps MR -> telegram message mapping, <config-file>.messages.yaml by default
+	MessageStore string `name:"message-store" yaml:"message-store,omitempty" help:"file to keep posted MR messages in"`
+	// ConfigBackups is how many previous versions of the config file are kept as <config-file>.<time>.bak
+	ConfigBackups int `name:"config-backups" yaml:"config-backups,omitempty" help:"previous config versions to keep, 5 by default"`
+	// Outbox journals notifications until they are delivered, <config-file>.outbox.jsonl by default
+	Outbox string `name:"outbox" yaml:"outbox,omitempty" help:"file to keep undelivered notifications in"`
 	//GitToken    string        `arg:"" name:"git-token" yaml:"git-token"`
-	AddProjects []string   `yaml:"-" arg:"" name:"new-projects" help:"list or projects to handle: project,reviewer1,reviewer2"`
+	AddProjects []string   `yaml:"-" name:"project" short:"p" sep:"none" help:"project to handle: url,@reviewer1,@reviewer2; repeat for more projects"`
 	lock        sync.Mutex `kong:"-" yaml:"-"`
 	changed     bool
 	syncPath    string
+	// overrides are keys taken from the environment, they are not written to the file
+	overrides map[string]envOverride
+	// undeclared are project and reviewer indexes of project reviewers migrate added to reviewers
+	undeclared [][2]int
+	// pending keep file values of keys read on start only which changed on reload, the running values stay in memory
+	pending map[string]envOverride
+	// version counts marshalled snapshots, they are written in order outside of lock
+	version uint64
+	// writeLock guards the file, the fields below and the backups
+	writeLock sync.Mutex
+	persisted uint64
+	// written is hash of the config file content last written or loaded by the bot
+	written     [sha256.Size]byte
+	writeFailed bool
+	onWriteFail func(err error)
 }
 
 func (c *Config) FastLock() func() {
 	c.lock.Lock()
 	logrus.Debugf("locked")
 	return func() {
+		var data []byte
+		var version uint64
 		if c.changed && c.syncPath != "" {
 			// sync conf
-			data, err := yaml.Marshal(c)
+			var err error
+			data, err = yaml.Marshal(c.persistent())
 			if err != nil {
 				logrus.Errorf("can't marshal config: %v", err)
 			} else {
-				err = ioutil.WriteFile(c.syncPath, data, 0644)
-				if err != nil {
-					logrus.Errorf("can't synchronize config: %v", err)
-				}
+				c.version++
+				version = c.version
 			}
 
 			c.changed = false
 		}
+		path, keep := c.syncPath, c.ConfigBackups
 
 		c.lock.Unlock()
 		logrus.Debugf("unlocked")
+		if data != nil {
+			_ = c.persist(path, data, version, keep)
+		}
 	}
 }
 
+// Flush waits for the config being written and writes pending changes
+func (c *Config) Flush() {
+	(c.FastLock())()
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+}
+
 func (c *Config) markChanged() {
 	c.changed = true
 }
@@ -86,32 +199,64 @@ func (c *Config) setSyncPath(path string) {
 	c.syncPath = path
 }
 
-func (c *Config) ParseProjectsToAdd() error {
-	defer (c.FastLock())()
+func (c *Config) setWriteFailHandler(handler func(err error)) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.onWriteFail = handler
+}
 
-	projectsInfo := make([]ProjectInfo, len(c.AddProjects))
-	reviewers := make(map[string]struct{})
-	for idx := range c.AddProjects {
-		if len(c.AddProjects[idx]) == 0 {
-			continue
-		}
-		splited := strings.Split(c.AddProjects[idx], ",")
-		projectsInfo[idx] = ProjectInfo{
-			Project: splited[0],
-		}
-		if len(splited) > 1 {
-			projectsInfo[idx].Reviewers = splited[1:]
-			for _, reviewer := range splited[1:] {
-				reviewers[reviewer] = struct{}{}
+// migrate moves old settings to the new ones, they are written on the next config change
+func (c *Config) migrate() {
+	if c.WebHookListen == "" && c.WebHookPort != 0 {
+		c.WebHookListen = strconv.Itoa(c.WebHookPort)
+		c.WebHookPort = 0
+	}
+	// project reviewers didn't have to be declared in reviewers before
+	declared := make(map[string]bool)
+	for _, reviewer := range c.Reviewers {
+		declared[reviewer.Key()] = true
+	}
+	c.undeclared = nil
+	for pidx, project := range c.Projects {
+		for ridx, key := range project.Reviewers {
+			if declared[key] {
+				continue
 			}
+			declared[key] = true
+			c.Reviewers = append(c.Reviewers, ParseReviewer(key))
+			c.undeclared = append(c.undeclared, [2]int{pidx, ridx})
 		}
 	}
-	c.Projects = projectsInfo
-	c.Reviewers = make([]string, 0)
-	for reviewer := range reviewers {
-		c.Reviewers = append(c.Reviewers, reviewer)
+}
+
+// ListenAddress returns webhook listen address
+func (c *Config) ListenAddress() string {
+	defer (c.FastLock())()
+	return listenAddress(c.WebHookListen)
+}
+
+// WebHookLimits returns webhook request body size and timeouts, defaults for unset values
+func (c *Config) WebHookLimits() (maxBodySize int64, readTimeout, writeTimeout time.Duration) {
+	defer (c.FastLock())()
+	maxBodySize, readTimeout, writeTimeout = c.WebHookMaxBodySize, c.WebHookReadTimeout, c.WebHookWriteTimeout
+	if maxBodySize <= 0 {
+		maxBodySize = DefaultWebHookMaxBodySize
+	}
+	if readTimeout <= 0 {
+		readTimeout = DefaultWebHookTimeout
 	}
-	return nil
+	if writeTimeout <= 0 {
+		writeTimeout = DefaultWebHookTimeout
+	}
+	return
+}
+
+// listenAddress turns plain port to :port
+func listenAddress(listen string) string {
+	if _, err := strconv.Atoi(listen); err == nil {
+		return ":" + listen
+	}
+	return listen
 }
 
 func (c *Config) GetProjectReviewers(project string) []string {
@@ -124,6 +269,43 @@ func (c *Config) GetProjectReviewers(project string) []string {
 	return nil
 }
 
+func (c *Config) IsProjectActionEnabled(project string, action string) bool {
+	defer (c.FastLock())()
+	for idx := range c.Projects {
+		if c.Projects[idx].Project == project {
+			return c.Projects[idx].HasAction(action)
+		}
+	}
+	return hasAction(DefaultActions, action)
+}
+
+func (c *Config) IsPipelineStatusEnabled(status string) bool {
+	defer (c.FastLock())()
+	if len(c.PipelineStatuses) == 0 {
+		return hasAction(DefaultPipelineStatuses, status)
+	}
+	return hasAction(c.PipelineStatuses, status)
+}
+
+// GetProjectSecret returns the X-Gitlab-Token expected for the project.
+// required is false only when no secrets are configured at all, so old configs keep working.
+func (c *Config) GetProjectSecret(project string) (secret string, required bool) {
+	defer (c.FastLock())()
+	required = c.WebHookSecret != ""
+	for _, prj := range c.Projects {
+		if prj.Secret != "" {
+			required = true
+		}
+		if prj.Project == project && prj.Secret != "" {
+			secret = prj.Secret
+		}
+	}
+	if secret == "" {
+		secret = c.WebHookSecret
+	}
+	return secret, required
+}
+
 func (c *Config) hasProject(project string) bool {
 	for _, prj := range c.Projects {
 		if prj.Project == project {
@@ -133,16 +315,74 @@ func (c *Config) hasProject(project string) bool {
 	return false
 }
 
-func (c *Config) IsAdmin(chatId int64) bool {
-	return c.Telegram.AdminChatId == chatId
+func (c *Config) AddProject(project string) bool {
+	defer (c.FastLock())()
+	if c.hasProject(project) {
+		return false
+	}
+	c.Projects = append(c.Projects, ProjectInfo{Project: project, Reviewers: make([]string, 0)})
+	c.markChanged()
+	return true
+}
+
+// RemoveProject removes the project, maintainers lose it too
+func (c *Config) RemoveProject(project string) bool {
+	defer (c.FastLock())()
+	projects := make([]ProjectInfo, 0, len(c.Projects))
+	for _, prj := range c.Projects {
+		if prj.Project != project {
+			projects = append(projects, prj)
+		}
+	}
+	if len(projects) == len(c.Projects) {
+		return false
+	}
+	c.Projects = projects
+	for idx := range c.Admins {
+		kept := make([]string, 0, len(c.Admins[idx].Projects))
+		for _, owned := range c.Admins[idx].Projects {
+			if owned != project {
+				kept = append(kept, owned)
+			}
+		}
+		c.Admins[idx].Projects = kept
+	}
+	c.markChanged()
+	return true
 }
 
-func (c *Config) IsChannel(chatId int64) bool {
-	return c.Telegram.ChannelChatId == chatId
+// RenameProject changes url of the project keeping its settings, e.g. when the project is moved in gitlab
+func (c *Config) RenameProject(project string, newProject string) bool {
+	defer (c.FastLock())()
+	if !c.hasProject(project) || c.hasProject(newProject) {
+		return false
+	}
+	for idx := range c.Projects {
+		if c.Projects[idx].Project == project {
+			c.Projects[idx].Project = newProject
+		}
+	}
+	for idx := range c.Admins {
+		for pidx, owned := range c.Admins[idx].Projects {
+			if owned == project {
+				c.Admins[idx].Projects[pidx] = newProject
+			}
+		}
+	}
+	c.markChanged()
+	return true
+}
+
+// AdminChat returns the admin chat id, it may change on reload
+func (c *Config) AdminChat() int64 {
+	defer (c.FastLock())()
+	return c.Telegram.AdminChatId
 }
 
-func (c *Config) UnexpectedChat(chatId int64) bool {
-	return !(c.IsChannel(chatId) || c.IsAdmin(chatId))
+// Channel returns the chat and the thread to announce MRs in
+func (c *Config) Channel() (chatId int64, threadId int64) {
+	defer (c.FastLock())()
+	return c.Telegram.ChannelChatId, c.Telegram.ThreadId
 }
 
 func (c *Config) ListProjects() []string {
@@ -155,17 +395,59 @@ func (c *Config) ListProjects() []string {
 }
 
 func (c *Config) ListReviewers() []string {
-	return c.Reviewers
+	defer (c.FastLock())()
+	reviewers := make([]string, len(c.Reviewers))
+	for idx := range c.Reviewers {
+		reviewers[idx] = c.Reviewers[idx].Key()
+	}
+	return reviewers
 }
 
-func (c *Config) hasReviewer(reviewerToFind string) bool {
-	logrus.Debugf("all reviewers: %v need fount: %s", c.Reviewers, reviewerToFind)
+func (c *Config) findReviewer(key string) (Reviewer, bool) {
 	for _, reviewer := range c.Reviewers {
-		if reviewer == reviewerToFind {
-			return true
+		if reviewer.Key() == key {
+			return reviewer, true
 		}
 	}
-	return false
+	return Reviewer{}, false
+}
+
+// ResolveReviewers converts reviewer keys from project lists to reviewers
+func (c *Config) ResolveReviewers(keys []string) []Reviewer {
+	defer (c.FastLock())()
+	reviewers := make([]Reviewer, len(keys))
+	for idx, key := range keys {
+		reviewer, ok := c.findReviewer(key)
+		if !ok {
+			reviewer = ParseReviewer(key)
+		}
+		reviewers[idx] = reviewer
+	}
+	return reviewers
+}
+
+// FindGitLabUser looks for telegram identity of gitlab user in reviewers and users mapping
+func (c *Config) FindGitLabUser(username string, userId int) (Reviewer, bool) {
+	defer (c.FastLock())()
+	for _, reviewer := range c.Reviewers {
+		if reviewer.isGitLabUser(username, userId) {
+			return reviewer, true
+		}
+	}
+	if handle := c.Users[username]; username != "" && handle != "" {
+		return Reviewer{
+			GitLabUsername:   username,
+			GitLabUserId:     userId,
+			TelegramUsername: strings.TrimPrefix(handle, "@"),
+		}, true
+	}
+	return Reviewer{GitLabUsername: username, GitLabUserId: userId}, false
+}
+
+func (c *Config) hasReviewer(reviewerToFind string) bool {
+	logrus.Debugf("all reviewers: %v need fount: %s", c.Reviewers, reviewerToFind)
+	_, ok := c.findReviewer(reviewerToFind)
+	return ok
 }
 
 func (c *Config) AddReviewer(reviewer string) bool {
@@ -173,7 +455,7 @@ func (c *Config) AddReviewer(reviewer string) bool {
 	if c.hasReviewer(reviewer) {
 		return false
 	}
-	c.Reviewers = append(c.Reviewers, reviewer)
+	c.Reviewers = append(c.Reviewers, ParseReviewer(reviewer))
 	c.markChanged()
 	return true
 }
@@ -182,9 +464,9 @@ func (c *Config) RemoveReviewer(reviewerToRemove string) bool {
 	defer (c.FastLock())()
 	if c.hasReviewer(reviewerToRemove) {
 		oldReviewers := c.Reviewers
-		c.Reviewers = make([]string, 0)
+		c.Reviewers = make([]Reviewer, 0)
 		for _, reviewer := range oldReviewers {
-			if reviewerToRemove == reviewer {
+			if reviewerToRemove == reviewer.Key() {
 				continue
 			}
 			c.Reviewers = append(c.Reviewers, reviewer)
@@ -200,6 +482,43 @@ func (c *Config) RemoveReviewer(reviewerToRemove string) bool {
 	return false
 }
 
+// SaveReviewer declares the reviewer, returns key of the reviewer and false if it is known already:
+// then missing telegram details are filled in
+func (c *Config) SaveReviewer(reviewer Reviewer) (string, bool) {
+	defer (c.FastLock())()
+	for idx := range c.Reviewers {
+		known := &c.Reviewers[idx]
+		if known.Key() != reviewer.Key() && (reviewer.TelegramUserId == 0 || known.TelegramUserId != reviewer.TelegramUserId) {
+			continue
+		}
+		if known.TelegramUserId == 0 && reviewer.TelegramUserId != 0 {
+			known.TelegramUserId = reviewer.TelegramUserId
+			c.markChanged()
+		}
+		// display name is the key of reviewers without usernames, it is kept
+		if known.DisplayName == "" && reviewer.DisplayName != "" && (known.TelegramUsername != "" || known.GitLabUsername != "") {
+			known.DisplayName = reviewer.DisplayName
+			c.markChanged()
+		}
+		return known.Key(), false
+	}
+	c.Reviewers = append(c.Reviewers, reviewer)
+	c.markChanged()
+	return reviewer.Key(), true
+}
+
+// ReviewerProjects lists projects of the reviewer
+func (c *Config) ReviewerProjects(reviewer string) []string {
+	defer (c.FastLock())()
+	projects := make([]string, 0)
+	for _, project := range c.Projects {
+		if project.HasReviewer(reviewer) {
+			projects = append(projects, project.Project)
+		}
+	}
+	return projects
+}
+
 func (c *Config) HasProjectReviewer(project string, reviewer string) bool {
 	reviewers := c.GetProjectReviewers(project)
 
@@ -0,0 +1,89 @@
+package notifier
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const DefaultDedupWindow = time.Hour
+
+// Deduplicator remembers webhook deliveries for the window, persisted when path is set
+type Deduplicator struct {
+	path   string
+	window time.Duration
+	lock   sync.Mutex
+	seen   map[string]time.Time
+}
+
+func NewDeduplicator(window time.Duration, path string) (*Deduplicator, error) {
+	if window <= 0 {
+		window = DefaultDedupWindow
+	}
+	d := &Deduplicator{
+		path:   path,
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+	if path == "" {
+		return d, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return d, nil
+		}
+		return nil, err
+	}
+	err = yaml.Unmarshal(data, &d.seen)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse dedup store %s: %w", path, err)
+	}
+	if d.seen == nil {
+		d.seen = make(map[string]time.Time)
+	}
+	return d, nil
+}
+
+// Seen is true if the key was seen within the window, otherwise the key is remembered
+func (d *Deduplicator) Seen(key string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	now := time.Now()
+	if at, ok := d.seen[key]; ok && now.Sub(at) < d.window {
+		return true
+	}
+	d.seen[key] = now
+	d.save()
+	return false
+}
+
+// Forget drops the key, so the delivery is accepted when GitLab retries it
+func (d *Deduplicator) Forget(key string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.seen, key)
+	d.save()
+}
+
+func (d *Deduplicator) save() {
+	for key, at := range d.seen {
+		if time.Since(at) >= d.window {
+			delete(d.seen, key)
+		}
+	}
+	if d.path == "" {
+		return
+	}
+	data, err := yaml.Marshal(d.seen)
+	if err == nil {
+		err = writeFileAtomic(d.path, data, 0644)
+	}
+	if err != nil {
+		logrus.Errorf("can't save dedup store %s: %v", d.path, err)
+	}
+}
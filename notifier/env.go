@@ -0,0 +1,129 @@
+package notifier
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"reflect"
+	"strings"
+)
+
+// EnvPrefix starts environment variables overriding config keys: telegram.bot-api is MRN_TELEGRAM_BOT_API,
+// MRN_TELEGRAM_BOT_API_FILE names a file holding the value (docker and kubernetes secrets)
+const EnvPrefix = "MRN_"
+
+var envReplacer = strings.NewReplacer("-", "_", ".", "_")
+
+// EnvName returns environment variable name of the config key
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(envReplacer.Replace(key))
+}
+
+// envOverride keeps the file value of the overridden field, it is written back instead of the env value
+type envOverride struct {
+	index []int
+	file  reflect.Value
+}
+
+// configLeaves calls fn for every config key which is not a nested struct
+func configLeaves(t reflect.Type, prefix string, index []int, fn func(key string, index []int, field reflect.StructField)) {
+	for idx := 0; idx < t.NumField(); idx++ {
+		field := t.Field(idx)
+		name := yamlName(field)
+		if field.PkgPath != "" || name == "-" {
+			continue
+		}
+		fieldIndex := append(append([]int(nil), index...), idx)
+		if field.Type.Kind() == reflect.Struct && field.Type.NumField() > 0 && field.Type.Field(0).PkgPath == "" {
+			configLeaves(field.Type, prefix+name+".", fieldIndex, fn)
+			continue
+		}
+		fn(prefix+name, fieldIndex, field)
+	}
+}
+
+// lookupEnv returns value of the variable or content of the file named by <name>_FILE
+func lookupEnv(lookup func(string) (string, bool), name string) (string, bool, error) {
+	value, ok := lookup(name)
+	path, fromFile := lookup(name + "_FILE")
+	switch {
+	case ok && fromFile:
+		return "", false, fmt.Errorf("both %s and %s_FILE are set", name, name)
+	case fromFile:
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", false, fmt.Errorf("%s_FILE: %v", name, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), true, nil
+	}
+	return value, ok, nil
+}
+
+// applyEnv overrides config keys by environment variables, values other than strings are parsed as yaml
+func (c *Config) applyEnv(lookup func(string) (string, bool)) ValidationErrors {
+	problems := make(ValidationErrors, 0)
+	c.overrides = make(map[string]envOverride)
+	root := reflect.ValueOf(c).Elem()
+	configLeaves(root.Type(), "", nil, func(key string, index []int, field reflect.StructField) {
+		name := EnvName(key)
+		value, ok, err := lookupEnv(lookup, name)
+		if err != nil {
+			problems = append(problems, ValidationError{Message: err.Error()})
+			return
+		}
+		if !ok {
+			return
+		}
+		fresh := reflect.New(field.Type)
+		if field.Type.Kind() == reflect.String {
+			fresh.Elem().SetString(value)
+		} else if err = yaml.Unmarshal([]byte(value), fresh.Interface()); err != nil {
+			message := yamlError(err).Message
+			if typeErr, ok := err.(*yaml.TypeError); ok {
+				message = yamlError(errors.New(typeErr.Errors[0])).Message
+			}
+			problems = append(problems, ValidationError{Message: fmt.Sprintf("%s: %s", name, message)})
+			return
+		}
+		target := root.FieldByIndex(index)
+		file := reflect.New(field.Type).Elem()
+		file.Set(target)
+		c.overrides[key] = envOverride{index: index, file: file}
+		target.Set(fresh.Elem())
+	})
+	return problems
+}
+
+// Overridden lists config keys taken from the environment
+func (c *Config) Overridden() []string {
+	keys := make([]string, 0, len(c.overrides))
+	configLeaves(reflect.TypeOf(c).Elem(), "", nil, func(key string, index []int, field reflect.StructField) {
+		if _, ok := c.overrides[key]; ok {
+			keys = append(keys, key)
+		}
+	})
+	return keys
+}
+
+// persistent returns config to be written to the file: overridden keys and keys waiting for restart keep their file values
+func (c *Config) persistent() *Config {
+	if len(c.overrides) == 0 && len(c.pending) == 0 {
+		return c
+	}
+	out := &Config{}
+	dst := reflect.ValueOf(out).Elem()
+	src := reflect.ValueOf(c).Elem()
+	for idx := 0; idx < dst.NumField(); idx++ {
+		if dst.Type().Field(idx).PkgPath == "" {
+			dst.Field(idx).Set(src.Field(idx))
+		}
+	}
+	for _, override := range c.overrides {
+		dst.FieldByIndex(override.index).Set(override.file)
+	}
+	for _, override := range c.pending {
+		dst.FieldByIndex(override.index).Set(override.file)
+	}
+	return out
+}
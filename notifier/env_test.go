@@ -0,0 +1,171 @@
+package notifier
+
+import (
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvName(t *testing.T) {
+	tests := map[string]string{
+		"telegram.bot-api":  "MRN_TELEGRAM_BOT_API",
+		"web-hook-secret":   "MRN_WEB_HOOK_SECRET",
+		"tls.client-ca":     "MRN_TLS_CLIENT_CA",
+		"pipeline-statuses": "MRN_PIPELINE_STATUSES",
+	}
+	for key, want := range tests {
+		if got := EnvName(key); got != want {
+			t.Errorf("EnvName(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+const envTestConfig = `telegram:
+    bot-api: file-token
+    channel-chat-id: -1
+    admin-chat-id: -2
+web-hook-path: /webhook
+web-hook-listen: :7777
+`
+
+func TestApplyEnv(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "bot-token")
+	if err := ioutil.WriteFile(secret, []byte("secret-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		env        map[string]string
+		check      func(c *Config) interface{}
+		want       interface{}
+		overridden []string
+		problem    string
+	}{
+		{
+			name:       "string",
+			env:        map[string]string{"MRN_TELEGRAM_BOT_API": "env-token"},
+			check:      func(c *Config) interface{} { return c.Telegram.BotApi },
+			want:       "env-token",
+			overridden: []string{"telegram.bot-api"},
+		},
+		{
+			name:       "string is not yaml",
+			env:        map[string]string{"MRN_WEB_HOOK_SECRET": "[not a list]"},
+			check:      func(c *Config) interface{} { return c.WebHookSecret },
+			want:       "[not a list]",
+			overridden: []string{"web-hook-secret"},
+		},
+		{
+			name:       "from file",
+			env:        map[string]string{"MRN_TELEGRAM_BOT_API_FILE": secret},
+			check:      func(c *Config) interface{} { return c.Telegram.BotApi },
+			want:       "secret-token",
+			overridden: []string{"telegram.bot-api"},
+		},
+		{
+			name:       "number",
+			env:        map[string]string{"MRN_TELEGRAM_CHANNEL_CHAT_ID": "-100123"},
+			check:      func(c *Config) interface{} { return c.Telegram.ChannelChatId },
+			want:       int64(-100123),
+			overridden: []string{"telegram.channel-chat-id"},
+		},
+		{
+			name:       "duration",
+			env:        map[string]string{"MRN_DEDUP_WINDOW": "10m"},
+			check:      func(c *Config) interface{} { return c.DedupWindow },
+			want:       10 * time.Minute,
+			overridden: []string{"dedup-window"},
+		},
+		{
+			name:       "yaml list",
+			env:        map[string]string{"MRN_PIPELINE_STATUSES": "[failed, success]"},
+			check:      func(c *Config) interface{} { return c.PipelineStatuses },
+			want:       []string{"failed", "success"},
+			overridden: []string{"pipeline-statuses"},
+		},
+		{
+			name:       "yaml map",
+			env:        map[string]string{"MRN_USERS": "{alice: '@alice_tg'}"},
+			check:      func(c *Config) interface{} { return c.Users },
+			want:       map[string]string{"alice": "@alice_tg"},
+			overridden: []string{"users"},
+		},
+		{
+			name:       "nested struct",
+			env:        map[string]string{"MRN_TLS_CERT": "/certs/a.crt", "MRN_TLS_KEY": "/certs/a.key"},
+			check:      func(c *Config) interface{} { return c.TLS.Cert + " " + c.TLS.Key },
+			want:       "/certs/a.crt /certs/a.key",
+			overridden: []string{"tls.cert", "tls.key"},
+		},
+		{
+			name:    "both forms",
+			env:     map[string]string{"MRN_TELEGRAM_BOT_API": "a", "MRN_TELEGRAM_BOT_API_FILE": secret},
+			problem: "both MRN_TELEGRAM_BOT_API and MRN_TELEGRAM_BOT_API_FILE are set",
+		},
+		{
+			name:    "missing file",
+			env:     map[string]string{"MRN_TELEGRAM_BOT_API_FILE": secret + ".missing"},
+			problem: "MRN_TELEGRAM_BOT_API_FILE:",
+		},
+		{
+			name:    "bad number",
+			env:     map[string]string{"MRN_WEB_HOOK_WORKERS": "many"},
+			problem: "MRN_WEB_HOOK_WORKERS:",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var c Config
+			if err := yaml.Unmarshal([]byte(envTestConfig), &c); err != nil {
+				t.Fatal(err)
+			}
+			problems := c.applyEnv(func(name string) (string, bool) {
+				value, ok := test.env[name]
+				return value, ok
+			})
+			if test.problem != "" {
+				if len(problems) != 1 || !strings.Contains(problems[0].Message, test.problem) {
+					t.Errorf("problems %v, want %q", problems, test.problem)
+				}
+				return
+			}
+			if len(problems) > 0 {
+				t.Fatalf("unexpected problems: %v", problems)
+			}
+			if got := test.check(&c); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("value %#v, want %#v", got, test.want)
+			}
+			if got := c.Overridden(); !reflect.DeepEqual(got, test.overridden) {
+				t.Errorf("overridden %v, want %v", got, test.overridden)
+			}
+
+			// values from the environment are never written to the file
+			data, err := yaml.Marshal(c.persistent())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var written Config
+			if err = yaml.Unmarshal(data, &written); err != nil {
+				t.Fatal(err)
+			}
+			var file Config
+			_ = yaml.Unmarshal([]byte(envTestConfig), &file)
+			for _, key := range test.overridden {
+				configLeaves(reflect.TypeOf(&file).Elem(), "", nil, func(leaf string, index []int, field reflect.StructField) {
+					if leaf != key {
+						return
+					}
+					got := reflect.ValueOf(&written).Elem().FieldByIndex(index).Interface()
+					want := reflect.ValueOf(&file).Elem().FieldByIndex(index).Interface()
+					if !reflect.DeepEqual(got, want) {
+						t.Errorf("%s written as %#v, want file value %#v", key, got, want)
+					}
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,353 @@
+package notifier
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	ParseModeHTML       = "HTML"
+	ParseModeMarkdownV2 = "MarkdownV2"
+
+	// MaxMessageLength is telegram limit of message text length (after entities parsing)
+	MaxMessageLength = 4096
+)
+
+// Formatter builds message text for telegram parse mode, all arguments are raw text
+type Formatter interface {
+	ParseMode() string
+	Escape(text string) string
+	Bold(text string) string
+	Italic(text string) string
+	Code(text string) string
+	Link(url string, text string) string
+	Mention(person Reviewer) string
+	// Fit cuts formatted text to the telegram limit keeping markup valid
+	Fit(text string, limit int) string
+}
+
+func NewFormatter(parseMode string) Formatter {
+	if strings.EqualFold(parseMode, ParseModeMarkdownV2) {
+		return markdownV2Formatter{}
+	}
+	return htmlFormatter{}
+}
+
+func (c *Config) Formatter() Formatter {
+	defer (c.FastLock())()
+	return NewFormatter(c.Telegram.ParseMode)
+}
+
+// utf16Len is length of the rune in telegram (UTF-16) characters
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+type htmlFormatter struct{}
+
+func (htmlFormatter) ParseMode() string {
+	return ParseModeHTML
+}
+
+func (htmlFormatter) Escape(text string) string {
+	return html.EscapeString(text)
+}
+
+func (f htmlFormatter) Bold(text string) string {
+	return "<b>" + f.Escape(text) + "</b>"
+}
+
+func (f htmlFormatter) Italic(text string) string {
+	return "<i>" + f.Escape(text) + "</i>"
+}
+
+func (f htmlFormatter) Code(text string) string {
+	return "<code>" + f.Escape(text) + "</code>"
+}
+
+func (f htmlFormatter) Link(url string, text string) string {
+	if url == "" {
+		return f.Escape(text)
+	}
+	return `<a href="` + f.Escape(url) + `">` + f.Escape(text) + "</a>"
+}
+
+func (f htmlFormatter) Mention(person Reviewer) string {
+	switch {
+	case person.TelegramUserId != 0:
+		return f.Link(fmt.Sprintf("tg://user?id=%d", person.TelegramUserId), person.Name())
+	case person.TelegramUsername != "":
+		return "@" + f.Escape(person.TelegramUsername)
+	}
+	return f.Escape(person.Name())
+}
+
+// htmlLength is visible length of html text: tags are skipped, entities are one character
+func htmlLength(text string) int {
+	length := 0
+	for i := 0; i < len(text); {
+		switch text[i] {
+		case '<':
+			if end := strings.IndexByte(text[i:], '>'); end >= 0 {
+				i += end + 1
+				continue
+			}
+		case '&':
+			if end := strings.IndexByte(text[i:], ';'); end >= 0 {
+				length++
+				i += end + 1
+				continue
+			}
+		}
+		r, size := utf8.DecodeRuneInString(text[i:])
+		length += utf16Len(r)
+		i += size
+	}
+	return length
+}
+
+func (htmlFormatter) Fit(text string, limit int) string {
+	if htmlLength(text) <= limit {
+		return text
+	}
+	var out strings.Builder
+	tags := make([]string, 0)
+	visible := 0
+	// reserve place for ellipsis
+	limit--
+loop:
+	for i := 0; i < len(text); {
+		switch text[i] {
+		case '<':
+			end := strings.IndexByte(text[i:], '>')
+			if end < 0 {
+				i = len(text)
+				continue
+			}
+			tag := text[i : i+end+1]
+			name := strings.Trim(strings.Fields(strings.Trim(tag, "<>/") + " x")[0], "/")
+			if strings.HasPrefix(tag, "</") {
+				if len(tags) > 0 {
+					tags = tags[:len(tags)-1]
+				}
+			} else {
+				tags = append(tags, name)
+			}
+			out.WriteString(tag)
+			i += end + 1
+			continue
+		case '&':
+			if visible >= limit {
+				break loop
+			}
+			end := strings.IndexByte(text[i:], ';')
+			if end < 0 {
+				end = 0
+			}
+			out.WriteString(text[i : i+end+1])
+			visible++
+			i += end + 1
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(text[i:])
+		if visible+utf16Len(r) > limit {
+			break
+		}
+		out.WriteString(text[i : i+size])
+		visible += utf16Len(r)
+		i += size
+	}
+	out.WriteString("…")
+	for idx := len(tags) - 1; idx >= 0; idx-- {
+		out.WriteString("</" + tags[idx] + ">")
+	}
+	return out.String()
+}
+
+type markdownV2Formatter struct{}
+
+const markdownV2Special = "_*[]()~`>#+-=|{}.!\\"
+
+func (markdownV2Formatter) ParseMode() string {
+	return ParseModeMarkdownV2
+}
+
+func (markdownV2Formatter) Escape(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		if strings.ContainsRune(markdownV2Special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (f markdownV2Formatter) Bold(text string) string {
+	return "*" + f.Escape(text) + "*"
+}
+
+func (f markdownV2Formatter) Italic(text string) string {
+	return "_" + f.Escape(text) + "_"
+}
+
+func (markdownV2Formatter) Code(text string) string {
+	return "`" + strings.NewReplacer("\\", "\\\\", "`", "\\`").Replace(text) + "`"
+}
+
+func (f markdownV2Formatter) Link(url string, text string) string {
+	if url == "" {
+		return f.Escape(text)
+	}
+	return "[" + f.Escape(text) + "](" + strings.NewReplacer("\\", "\\\\", ")", "\\)").Replace(url) + ")"
+}
+
+func (f markdownV2Formatter) Mention(person Reviewer) string {
+	switch {
+	case person.TelegramUserId != 0:
+		return f.Link(fmt.Sprintf("tg://user?id=%d", person.TelegramUserId), person.Name())
+	case person.TelegramUsername != "":
+		return "@" + f.Escape(person.TelegramUsername)
+	}
+	return f.Escape(person.Name())
+}
+
+// markdownV2Token returns length in bytes of the token at the text start, its visible length and formatting marker.
+// inside code spans (code is the opening marker) only backslash escapes and the closing marker are special
+func markdownV2Token(text string, code string) (size int, visible int, marker string) {
+	switch {
+	case text[0] == '\\' && len(text) > 1:
+		r, rsize := utf8.DecodeRuneInString(text[1:])
+		return 1 + rsize, utf16Len(r), ""
+	case code != "":
+		if strings.HasPrefix(text, code) {
+			return len(code), 0, code
+		}
+	case strings.HasPrefix(text, "```"):
+		return 3, 0, "```"
+	case strings.HasPrefix(text, "__"), strings.HasPrefix(text, "||"):
+		return 2, 0, text[:2]
+	case strings.ContainsRune("*_~`", rune(text[0])):
+		return 1, 0, text[:1]
+	}
+	r, rsize := utf8.DecodeRuneInString(text)
+	return rsize, utf16Len(r), ""
+}
+
+// markdownV2Link splits the link at the text start to its text and the "](url)" tail, ok is false when it is not a link
+func markdownV2Link(text string) (inner string, tail string, ok bool) {
+	if text[0] != '[' {
+		return "", "", false
+	}
+	for i := 1; i < len(text); i++ {
+		if text[i] == '\\' {
+			i++
+			continue
+		}
+		if text[i] != ']' {
+			continue
+		}
+		if !strings.HasPrefix(text[i:], "](") {
+			return "", "", false
+		}
+		end := i + 2
+		for end < len(text) && text[end] != ')' {
+			if text[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(text) {
+			end = len(text) - 1
+		}
+		return text[1:i], text[i : end+1], true
+	}
+	return "", "", false
+}
+
+func markdownV2Length(text string) int {
+	length := 0
+	code := ""
+	for i := 0; i < len(text); {
+		if inner, tail, ok := markdownV2Link(text[i:]); ok && code == "" {
+			length += markdownV2Length(inner)
+			i += 1 + len(inner) + len(tail)
+			continue
+		}
+		size, visible, marker := markdownV2Token(text[i:], code)
+		code = markdownV2Code(code, marker)
+		length += visible
+		i += size
+	}
+	return length
+}
+
+// markdownV2Code returns the code span marker after the token marker
+func markdownV2Code(code string, marker string) string {
+	switch {
+	case code != "" && marker == code:
+		return ""
+	case code == "" && (marker == "`" || marker == "```"):
+		return marker
+	}
+	return code
+}
+
+// markdownV2Cut cuts text to limit visible characters appending ellipsis and closing open markers,
+// cut is false when the whole text fits
+func markdownV2Cut(text string, limit int) (out string, cut bool) {
+	var b strings.Builder
+	markers := make([]string, 0)
+	code := ""
+	visible := 0
+	for i := 0; i < len(text); {
+		if inner, tail, ok := markdownV2Link(text[i:]); ok && code == "" {
+			length := markdownV2Length(inner)
+			if visible+length > limit {
+				// shorten the link text, the link itself stays
+				inner, _ = markdownV2Cut(inner, limit-visible)
+				b.WriteString("[" + inner + tail)
+				cut = true
+				break
+			}
+			b.WriteString(text[i : i+1+len(inner)+len(tail)])
+			visible += length
+			i += 1 + len(inner) + len(tail)
+			continue
+		}
+		size, length, marker := markdownV2Token(text[i:], code)
+		if marker != "" {
+			code = markdownV2Code(code, marker)
+			if len(markers) > 0 && markers[len(markers)-1] == marker {
+				markers = markers[:len(markers)-1]
+			} else {
+				markers = append(markers, marker)
+			}
+		} else if visible+length > limit {
+			b.WriteString("…")
+			cut = true
+			break
+		}
+		b.WriteString(text[i : i+size])
+		visible += length
+		i += size
+	}
+	for idx := len(markers) - 1; idx >= 0; idx-- {
+		b.WriteString(markers[idx])
+	}
+	return b.String(), cut
+}
+
+func (markdownV2Formatter) Fit(text string, limit int) string {
+	if markdownV2Length(text) <= limit {
+		return text
+	}
+	// reserve place for ellipsis
+	out, _ := markdownV2Cut(text, limit-1)
+	return out
+}
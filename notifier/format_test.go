@@ -0,0 +1,73 @@
+package notifier
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEscape(t *testing.T) {
+	tests := []struct {
+		mode string
+		text string
+		want string
+	}{
+		{ParseModeHTML, "plain", "plain"},
+		{ParseModeHTML, `a<b>&"c'`, "a&lt;b&gt;&amp;&#34;c&#39;"},
+		{ParseModeMarkdownV2, "plain", "plain"},
+		{ParseModeMarkdownV2, "feature_x", `feature\_x`},
+		{ParseModeMarkdownV2, "_*[]()~`>#+-=|{}.!\\", "\\_\\*\\[\\]\\(\\)\\~\\`\\>\\#\\+\\-\\=\\|\\{\\}\\.\\!\\\\"},
+		{ParseModeMarkdownV2, "привет, мир", "привет, мир"},
+	}
+	for _, test := range tests {
+		if got := NewFormatter(test.mode).Escape(test.text); got != test.want {
+			t.Errorf("%s Escape(%q) = %q, want %q", test.mode, test.text, got, test.want)
+		}
+	}
+}
+
+func TestFit(t *testing.T) {
+	tests := []struct {
+		name  string
+		mode  string
+		text  string
+		limit int
+		want  string
+	}{
+		{"html fits", ParseModeHTML, "<b>bold</b>", 4, "<b>bold</b>"},
+		{"html plain", ParseModeHTML, "abcdef", 4, "abc…"},
+		{"html closes tags", ParseModeHTML, "<b>bold <i>italic</i></b>", 7, "<b>bold <i>i…</i></b>"},
+		{"html keeps entities", ParseModeHTML, "a&amp;b&lt;cdef", 4, "a&amp;b…"},
+		{"html long link", ParseModeHTML, `<a href="http://x">long link text</a> tail`, 5, `<a href="http://x">long…</a>`},
+		{"html surrogate pair", ParseModeHTML, "ab😀cd", 4, "ab…"},
+		{"markdown fits", ParseModeMarkdownV2, `*bold\.*`, 5, `*bold\.*`},
+		{"markdown plain", ParseModeMarkdownV2, "abcdef", 4, "abc…"},
+		{"markdown escapes", ParseModeMarkdownV2, `a\.b\.c\.d`, 4, `a\.b…`},
+		{"markdown closes markers", ParseModeMarkdownV2, "*bold _italic_*", 7, "*bold _i…_*"},
+		{"markdown code underscore", ParseModeMarkdownV2, "`feature_x` description", 12, "`feature_x` d…"},
+		{"markdown cut in code", ParseModeMarkdownV2, "`feature_x_y*z` tail", 10, "`feature_x…`"},
+		{"markdown code escapes", ParseModeMarkdownV2, "`a\\`b` tail", 4, "`a\\`b`…"},
+		{"markdown pre", ParseModeMarkdownV2, "```\nfoo_bar\n``` tail", 6, "```\nfoo_…```"},
+		{"markdown link fits", ParseModeMarkdownV2, `[a\.b](http://x) tail`, 5, `[a\.b](http://x) …`},
+		{"markdown long link", ParseModeMarkdownV2, `[long link text](http://x/a\)b) tail`, 5, `[long…](http://x/a\)b)`},
+		{"markdown link after text", ParseModeMarkdownV2, `ab [long text](http://x)`, 6, `ab [lo…](http://x)`},
+		{"markdown bold link", ParseModeMarkdownV2, `*[long text](http://x)*`, 3, `*[lo…](http://x)*`},
+	}
+	for _, test := range tests {
+		got := NewFormatter(test.mode).Fit(test.text, test.limit)
+		if got != test.want {
+			t.Errorf("%s: Fit(%q, %d) = %q, want %q", test.name, test.text, test.limit, got, test.want)
+		}
+	}
+}
+
+func TestFitMarkdownV2Balanced(t *testing.T) {
+	f := NewFormatter(ParseModeMarkdownV2)
+	text := f.Code("feature_x") + " " + f.Italic(strings.Repeat("long description ", 400))
+	got := f.Fit(text, MaxMessageLength)
+	if !strings.HasPrefix(got, "`feature_x` _") || !strings.HasSuffix(got, "…_") {
+		t.Errorf("Fit cut %q...%q", got[:20], got[len(got)-20:])
+	}
+	if length := markdownV2Length(got); length > MaxMessageLength {
+		t.Errorf("Fit length %d exceeds %d", length, MaxMessageLength)
+	}
+}
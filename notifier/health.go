@@ -0,0 +1,138 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	healthCheckTimeout = 5 * time.Second
+	// maxPollAge is twice the long poll timeout with a margin
+	maxPollAge = 3 * time.Minute
+)
+
+// Health serves /healthz, /readyz and /version
+type Health struct {
+	Bot        *BotAPI
+	Outbox     *Outbox
+	Queue      *Queue
+	ConfigPath string
+	// UpdatesDone is closed when the telegram updates handler exits
+	UpdatesDone <-chan struct{}
+	Version     map[string]string
+
+	started  time.Time
+	stopping int32
+}
+
+type healthCheck struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type readiness struct {
+	Ready    bool                   `json:"ready"`
+	Checks   map[string]healthCheck `json:"checks"`
+	LastPoll *time.Time             `json:"last-poll,omitempty"`
+	Outbox   int                    `json:"outbox"`
+	Queue    int                    `json:"queue"`
+}
+
+func (h *Health) Handler() http.Handler {
+	h.started = time.Now()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok", "uptime": time.Since(h.started).Round(time.Second).String()})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		state := h.Ready(r.Context())
+		status := http.StatusOK
+		if !state.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, state)
+	})
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, h.Version)
+	})
+	return mux
+}
+
+// SetStopping makes the bot unready during shutdown
+func (h *Health) SetStopping() {
+	atomic.StoreInt32(&h.stopping, 1)
+}
+
+func (h *Health) Ready(ctx context.Context) readiness {
+	state := readiness{
+		Ready:  true,
+		Checks: make(map[string]healthCheck),
+		Outbox: h.Outbox.Len(),
+		Queue:  h.Queue.Len(),
+	}
+	check := func(name string, err error) {
+		if err != nil {
+			state.Ready = false
+			state.Checks[name] = healthCheck{Error: err.Error()}
+			return
+		}
+		state.Checks[name] = healthCheck{Ok: true}
+	}
+
+	if atomic.LoadInt32(&h.stopping) != 0 {
+		check("running", errors.New("bot is stopping"))
+	}
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	check("telegram", h.Bot.Call(ctx, "getMe", struct{}{}, nil))
+
+	lastPoll := h.Bot.LastPoll()
+	var pollErr error
+	select {
+	case <-h.UpdatesDone:
+		pollErr = errors.New("updates handler stopped")
+	default:
+		if lastPoll.IsZero() && time.Since(h.started) > maxPollAge {
+			pollErr = errors.New("no successful updates poll")
+		} else if !lastPoll.IsZero() && time.Since(lastPoll) > maxPollAge {
+			pollErr = errors.New("last updates poll is too old")
+		}
+	}
+	if !lastPoll.IsZero() {
+		state.LastPoll = &lastPoll
+	}
+	check("updates", pollErr)
+	check("config", writable(h.ConfigPath))
+	return state
+}
+
+// writable opens the file for writing without changing it and checks that backups and temp files
+// can be created next to it
+func writable(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	probe, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
+}
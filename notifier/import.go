@@ -0,0 +1,108 @@
+package notifier
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// ParseProject parses "url,@reviewer1,@reviewer2"
+func ParseProject(line string) ProjectInfo {
+	fields := strings.Split(line, ",")
+	project := ProjectInfo{Project: strings.TrimSpace(fields[0])}
+	for _, reviewer := range fields[1:] {
+		if reviewer = strings.TrimSpace(reviewer); reviewer != "" {
+			project.Reviewers = append(project.Reviewers, reviewer)
+		}
+	}
+	return project
+}
+
+// ImportProjects reads projects from csv (url,@reviewer1,@reviewer2 per line) or yaml file,
+// yaml is either a list of projects or a mapping with projects and reviewers like in the config
+func ImportProjects(path string) ([]ProjectInfo, []Reviewer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		projects, err := importCSV(data)
+		return projects, nil, err
+	case ".yaml", ".yml":
+		return importYAML(data)
+	}
+	return nil, nil, fmt.Errorf("%s: unknown import format, expected .csv, .yaml or .yml", path)
+}
+
+func importCSV(data []byte) ([]ProjectInfo, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+	projects := make([]ProjectInfo, 0)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return projects, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		if len(record) == 0 || strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		// optional header
+		if line == 1 && strings.EqualFold(strings.TrimSpace(record[0]), "project") {
+			continue
+		}
+		projects = append(projects, ParseProject(strings.Join(record, ",")))
+	}
+}
+
+func importYAML(data []byte) ([]ProjectInfo, []Reviewer, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, nil, err
+	}
+	if len(root.Content) > 0 && root.Content[0].Kind == yaml.SequenceNode {
+		projects := make([]ProjectInfo, 0)
+		err := root.Content[0].Decode(&projects)
+		return projects, nil, err
+	}
+	var imported struct {
+		Projects  []ProjectInfo `yaml:"projects"`
+		Reviewers []Reviewer    `yaml:"reviewers"`
+	}
+	err := root.Decode(&imported)
+	return imported.Projects, imported.Reviewers, err
+}
+
+// SetProjects replaces projects, reviewers of the projects missing from reviewers are declared
+func (c *Config) SetProjects(projects []ProjectInfo, reviewers []Reviewer) {
+	defer (c.FastLock())()
+	c.Projects = projects
+	c.Reviewers = make([]Reviewer, 0, len(reviewers))
+	declared := make(map[string]bool)
+	declare := func(reviewer Reviewer) {
+		if !declared[reviewer.Key()] {
+			declared[reviewer.Key()] = true
+			c.Reviewers = append(c.Reviewers, reviewer)
+		}
+	}
+	for _, reviewer := range reviewers {
+		declare(reviewer)
+	}
+	for _, project := range projects {
+		for _, reviewer := range project.Reviewers {
+			declare(ParseReviewer(reviewer))
+		}
+	}
+	c.markChanged()
+}
@@ -0,0 +1,153 @@
+package notifier
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StatusOpened     = "opened"
+	StatusReopened   = "reopened"
+	StatusApproved   = "approved"
+	StatusUnapproved = "approval revoked"
+	StatusMerged     = "merged"
+	StatusClosed     = "closed"
+)
+
+const (
+	maxChangelogEntries = 10
+	messageRecordTTL    = 90 * 24 * time.Hour
+)
+
+// MessageRecord describes telegram message announcing the MR
+type MessageRecord struct {
+	ChatId    int64    `yaml:"chat-id"`
+	ThreadId  int64    `yaml:"thread-id,omitempty"`
+	MessageId int      `yaml:"message-id"`
+	Text      string   `yaml:"text"`
+	ParseMode string   `yaml:"parse-mode,omitempty"`
+	Status    string   `yaml:"status"`
+	Changelog []string `yaml:"changelog,omitempty"`
+	// Author is gitlab username of the MR author, AuthorId is known even when the username is not
+	Author   string `yaml:"author,omitempty"`
+	AuthorId int    `yaml:"author-id,omitempty"`
+	// Pipelines keeps last reported status of MR pipelines
+	Pipelines map[int]string `yaml:"pipelines,omitempty"`
+	UpdatedAt time.Time      `yaml:"updated-at"`
+}
+
+// SetPipelineStatus returns false if the status was already reported
+func (r *MessageRecord) SetPipelineStatus(pipelineId int, status string) bool {
+	if r.Pipelines[pipelineId] == status {
+		return false
+	}
+	// copy, the map is shared with the record kept in the store
+	pipelines := make(map[int]string, len(r.Pipelines)+1)
+	for id, reported := range r.Pipelines {
+		pipelines[id] = reported
+	}
+	pipelines[pipelineId] = status
+	r.Pipelines = pipelines
+	return true
+}
+
+func (r *MessageRecord) AddChangelog(entry string) {
+	r.Changelog = append(r.Changelog, entry)
+	if len(r.Changelog) > maxChangelogEntries {
+		r.Changelog = r.Changelog[len(r.Changelog)-maxChangelogEntries:]
+	}
+}
+
+// Render returns full message text: announcement, status line and changelog
+func (r *MessageRecord) Render() string {
+	f := NewFormatter(r.ParseMode)
+	var b strings.Builder
+	b.WriteString(strings.TrimRight(r.Text, " \t\n"))
+	if r.Status != "" {
+		b.WriteString("\n\nstatus: ")
+		b.WriteString(f.Bold(r.Status))
+	}
+	if len(r.Changelog) > 0 {
+		b.WriteString("\nchangelog:")
+		for _, entry := range r.Changelog {
+			b.WriteString("\n" + f.Escape("- "))
+			b.WriteString(entry)
+		}
+	}
+	return f.Fit(b.String(), MaxMessageLength)
+}
+
+func MergeRequestKey(projectId int, iid int) string {
+	return fmt.Sprintf("%d!%d", projectId, iid)
+}
+
+// MessageStore persists MR -> telegram message mapping
+type MessageStore struct {
+	path    string
+	lock    sync.Mutex
+	records map[string]MessageRecord
+}
+
+func NewMessageStore(path string) (*MessageStore, error) {
+	store := &MessageStore{
+		path:    path,
+		records: make(map[string]MessageRecord),
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, err
+	}
+	err = yaml.Unmarshal(data, &store.records)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse message store %s: %w", path, err)
+	}
+	if store.records == nil {
+		store.records = make(map[string]MessageRecord)
+	}
+	return store, nil
+}
+
+func (s *MessageStore) Get(projectId int, iid int) (MessageRecord, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	record, ok := s.records[MergeRequestKey(projectId, iid)]
+	return record, ok
+}
+
+// Update changes the record atomically, update returns false to leave the store as is
+func (s *MessageStore) Update(projectId int, iid int, update func(record *MessageRecord, found bool) (bool, error)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := MergeRequestKey(projectId, iid)
+	record, found := s.records[key]
+	save, err := update(&record, found)
+	if err != nil || !save {
+		return err
+	}
+	return s.put(key, record)
+}
+
+func (s *MessageStore) put(key string, record MessageRecord) error {
+	record.UpdatedAt = time.Now()
+	s.records[key] = record
+	for key := range s.records {
+		if time.Since(s.records[key].UpdatedAt) > messageRecordTTL {
+			logrus.Debugf("forgetting message of MR %s", key)
+			delete(s.records, key)
+		}
+	}
+	data, err := yaml.Marshal(s.records)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0644)
+}
@@ -0,0 +1,267 @@
+package notifier
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	WebhookRequests = NewCounter("mr_notifier_webhook_requests_total",
+		"Webhook requests by event type, action, project and result.", "event", "action", "project", "result")
+	TelegramRequestDuration = NewHistogram("mr_notifier_telegram_request_duration_seconds",
+		"Telegram Bot API call latency.", []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}, "method")
+	TelegramErrors = NewCounter("mr_notifier_telegram_errors_total",
+		"Failed Telegram Bot API calls by error code.", "method", "code")
+	OutboxDeliveries = NewCounter("mr_notifier_outbox_deliveries_total",
+		"Outbox delivery attempts by item kind and result.", "kind", "result")
+	AdminCommands = NewCounter("mr_notifier_admin_commands_total",
+		"Admin chat commands by command and result.", "command", "result")
+)
+
+// metrics are written in registration order
+var (
+	metricsLock sync.Mutex
+	metrics     []metric
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+func register(m metric) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	metrics = append(metrics, m)
+}
+
+// WriteMetrics writes all metrics in prometheus text exposition format
+func WriteMetrics(w io.Writer) {
+	metricsLock.Lock()
+	registered := append([]metric(nil), metrics...)
+	metricsLock.Unlock()
+	for _, m := range registered {
+		m.write(w)
+	}
+}
+
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteMetrics(w)
+	})
+}
+
+// LabelOther replaces label values not known in advance, payload values would create unlimited series
+const LabelOther = "other"
+
+var (
+	// WebhookEvents are gitlab object kinds counted by name
+	WebhookEvents = []string{"merge_request", "pipeline", "note"}
+	// webhookActions are MR actions and pipeline statuses counted by name
+	webhookActions = append(append([]string(nil), DefaultActions...),
+		"created", "waiting_for_resource", "preparing", "pending", "running",
+		"success", "failed", "canceled", "skipped", "manual", "scheduled")
+)
+
+// KnownLabel returns the value if it is known, LabelOther otherwise
+func KnownLabel(value string, known []string) string {
+	if value == "" {
+		return ""
+	}
+	for _, item := range known {
+		if item == value {
+			return value
+		}
+	}
+	return LabelOther
+}
+
+// WebhookActionLabel limits action label to MR actions and pipeline statuses
+func WebhookActionLabel(action string) string {
+	return KnownLabel(action, webhookActions)
+}
+
+// ProjectLabel returns the project url when it is configured, LabelOther otherwise
+func (c *Config) ProjectLabel(project string) string {
+	defer (c.FastLock())()
+	if project == "" {
+		return ""
+	}
+	if c.hasProject(project) {
+		return project
+	}
+	return LabelOther
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for idx, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[idx])))
+	}
+	for idx := 0; idx+1 < len(extra); idx += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[idx], extra[idx+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// labelKey joins label values, \xff can't appear in utf-8 text
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// Counter is a counter with labels
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+	lock   sync.Mutex
+	values map[string]float64
+	order  map[string][]string
+}
+
+func NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+		order:  make(map[string][]string),
+	}
+	register(c)
+	return c
+}
+
+// Inc increments the counter for label values given in the declaration order
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *Counter) Add(delta float64, values ...string) {
+	key := labelKey(values)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[key] += delta
+	c.order[key] = values
+}
+
+func (c *Counter) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, c.order[key]), formatFloat(c.values[key]))
+	}
+}
+
+// Histogram is a histogram with labels
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	lock    sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	values []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, values ...string) {
+	key := labelKey(values)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{values: values, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+	for idx, bound := range h.buckets {
+		if value <= bound {
+			series.counts[idx]++
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+func (h *Histogram) write(w io.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := h.series[key]
+		for idx, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				formatLabels(h.labels, series.values, "le", formatFloat(bound)), series.counts[idx])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, series.values, "le", "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, series.values), formatFloat(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, series.values), series.count)
+	}
+}
+
+// GaugeFunc reports value of the function on every scrape
+type GaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func NewGaugeFunc(name string, help string, value func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, value: value}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.value()))
+}
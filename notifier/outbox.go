@@ -0,0 +1,367 @@
+package notifier
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// OutboxAnnounce posts MR message kept in MessageStore or edits already posted one
+	OutboxAnnounce = "announce"
+	// OutboxReply replies to MR message with the item text
+	OutboxReply = "reply"
+)
+
+const (
+	outboxRetryInterval = 10 * time.Second
+	// outboxStuckAfter is when undelivered item is reported to admin chat
+	outboxStuckAfter = 5 * time.Minute
+)
+
+// OutboxItem is a notification waiting for delivery, items of the same MR are delivered in order
+type OutboxItem struct {
+	Id        uint64    `json:"id"`
+	Kind      string    `json:"kind"`
+	ProjectId int       `json:"project-id"`
+	Iid       int       `json:"iid"`
+	Project   string    `json:"project,omitempty"`
+	Text      string    `json:"text,omitempty"`
+	ParseMode string    `json:"parse-mode,omitempty"`
+	CreatedAt time.Time `json:"created-at"`
+
+	Attempts  int    `json:"-"`
+	LastError string `json:"-"`
+	reported  bool
+}
+
+func (i OutboxItem) Key() string {
+	return MergeRequestKey(i.ProjectId, i.Iid)
+}
+
+func (i OutboxItem) String() string {
+	return fmt.Sprintf("%s of MR %s!%d", i.Kind, i.Project, i.Iid)
+}
+
+// outboxRecord is a line of outbox journal
+type outboxRecord struct {
+	Add  *OutboxItem `json:"add,omitempty"`
+	Done uint64      `json:"done,omitempty"`
+}
+
+// Outbox is append-only journal of notifications, survives restarts
+type Outbox struct {
+	path   string
+	lock   sync.Mutex
+	file   *os.File
+	nextId uint64
+	items  []*OutboxItem
+	wake   chan struct{}
+}
+
+// OpenOutbox replays the journal and compacts it to pending items
+func OpenOutbox(path string) (*Outbox, error) {
+	o := &Outbox{
+		path:   path,
+		nextId: 1,
+		items:  make([]*OutboxItem, 0),
+		wake:   make(chan struct{}, 1),
+	}
+	file, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		line := 0
+		for scanner.Scan() {
+			line++
+			var record outboxRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				// the last line may be cut by a crash
+				logrus.Warnf("outbox %s:%d is broken, skipped: %v", path, line, err)
+				continue
+			}
+			if record.Add != nil {
+				o.items = append(o.items, record.Add)
+				if record.Add.Id >= o.nextId {
+					o.nextId = record.Add.Id + 1
+				}
+			} else {
+				o.remove(record.Done)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("can't read outbox %s: %w", path, err)
+		}
+	}
+	if err := o.compact(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// compact rewrites the journal with pending items only
+func (o *Outbox) compact() error {
+	if o.file != nil {
+		_ = o.file.Close()
+	}
+	file, err := os.OpenFile(o.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	o.file = file
+	for _, item := range o.items {
+		if err := o.write(outboxRecord{Add: item}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *Outbox) write(record outboxRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err = o.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return o.file.Sync()
+}
+
+func (o *Outbox) remove(id uint64) {
+	for idx, item := range o.items {
+		if item.Id == id {
+			o.items = append(o.items[:idx], o.items[idx+1:]...)
+			return
+		}
+	}
+}
+
+// Add stores the item on disk and wakes up delivery
+func (o *Outbox) Add(item OutboxItem) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	item.Id = o.nextId
+	item.CreatedAt = time.Now()
+	if err := o.write(outboxRecord{Add: &item}); err != nil {
+		return fmt.Errorf("can't write outbox %s: %w", o.path, err)
+	}
+	o.nextId++
+	o.items = append(o.items, &item)
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Done forgets delivered (or dropped) item
+func (o *Outbox) Done(id uint64) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.remove(id)
+	if len(o.items) == 0 {
+		return o.compact()
+	}
+	return o.write(outboxRecord{Done: id})
+}
+
+// failed records delivery failure, returns true when the item became stuck
+func (o *Outbox) failed(id uint64, err error) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for _, item := range o.items {
+		if item.Id == id {
+			item.Attempts++
+			item.LastError = err.Error()
+			if !item.reported && time.Since(item.CreatedAt) > outboxStuckAfter {
+				item.reported = true
+				return true
+			}
+			return false
+		}
+	}
+	return false
+}
+
+// Pending returns copies of items waiting for delivery
+func (o *Outbox) Pending() []OutboxItem {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	items := make([]OutboxItem, 0, len(o.items))
+	for _, item := range o.items {
+		items = append(items, *item)
+	}
+	return items
+}
+
+func (o *Outbox) Close() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.file.Close()
+}
+
+func (o *Outbox) Len() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return len(o.items)
+}
+
+// OutboxWorker delivers outbox items to telegram
+type OutboxWorker struct {
+	Outbox   *Outbox
+	Bot      Messenger
+	Messages *MessageStore
+	// AdminChat returns the chat to report stuck and dropped notifications to
+	AdminChat func() int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewOutboxWorker(outbox *Outbox, bot Messenger, messages *MessageStore, adminChat func() int64) *OutboxWorker {
+	return &OutboxWorker{
+		Outbox:    outbox,
+		Bot:       bot,
+		Messages:  messages,
+		AdminChat: adminChat,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Run drains the outbox until Stop is called
+func (w *OutboxWorker) Run() {
+	defer close(w.done)
+	for {
+		w.Drain()
+		select {
+		case <-w.stop:
+			return
+		case <-w.Outbox.wake:
+		case <-time.After(outboxRetryInterval):
+		}
+	}
+}
+
+// Stop waits for the delivery in progress, undelivered items stay in the outbox
+func (w *OutboxWorker) Stop() {
+	close(w.stop)
+	<-w.done
+}
+
+func (w *OutboxWorker) stopped() bool {
+	select {
+	case <-w.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Drain tries to deliver every pending item once, a failed item holds next items of its MR
+func (w *OutboxWorker) Drain() {
+	blocked := make(map[string]bool)
+	for _, item := range w.Outbox.Pending() {
+		if w.stopped() {
+			return
+		}
+		if blocked[item.Key()] {
+			continue
+		}
+		err := w.deliver(item)
+		if err != nil && isRetryable(err) {
+			OutboxDeliveries.Inc(item.Kind, "failed")
+			blocked[item.Key()] = true
+			logrus.Warnf("can't deliver %s (attempt %d): %v", item, item.Attempts+1, err)
+			if w.Outbox.failed(item.Id, err) {
+				w.notifyAdmin(fmt.Sprintf("%s is stuck since %s: %v",
+					item, item.CreatedAt.Format(time.RFC3339), err))
+			}
+			continue
+		}
+		if err != nil {
+			OutboxDeliveries.Inc(item.Kind, "dropped")
+			logrus.Errorf("can't deliver %s, dropped: %v", item, err)
+			w.notifyAdmin(fmt.Sprintf("%s dropped: %v", item, err))
+		} else {
+			OutboxDeliveries.Inc(item.Kind, "delivered")
+			if item.reported {
+				w.notifyAdmin(fmt.Sprintf("%s delivered after %d attempts", item, item.Attempts+1))
+			}
+		}
+		if err = w.Outbox.Done(item.Id); err != nil {
+			logrus.Errorf("can't update outbox: %v", err)
+		}
+	}
+}
+
+func (w *OutboxWorker) notifyAdmin(text string) {
+	_, err := w.Bot.Send(SendMessageRequest{ChatId: w.AdminChat(), Text: "outbox: " + text})
+	if err != nil {
+		logrus.Errorf("can't notify admin: %v", err)
+	}
+}
+
+func (w *OutboxWorker) deliver(item OutboxItem) error {
+	record, found := w.Messages.Get(item.ProjectId, item.Iid)
+	if !found {
+		logrus.Warnf("no message for %s, skipped", item)
+		return nil
+	}
+	switch item.Kind {
+	case OutboxAnnounce:
+		return w.announce(item, record)
+	case OutboxReply:
+		_, err := w.Bot.Reply(record.MessageId, SendMessageRequest{
+			ChatId:          record.ChatId,
+			MessageThreadId: record.ThreadId,
+			Text:            item.Text,
+			ParseMode:       item.ParseMode,
+		})
+		return err
+	}
+	logrus.Warnf("unknown outbox item %s, skipped", item)
+	return nil
+}
+
+// announce edits the MR message or posts it when it wasn't posted yet (or was deleted)
+func (w *OutboxWorker) announce(item OutboxItem, record MessageRecord) error {
+	parseMode := NewFormatter(record.ParseMode).ParseMode()
+	if record.MessageId != 0 {
+		err := w.Bot.Edit(EditMessageTextRequest{
+			ChatId:    record.ChatId,
+			MessageId: record.MessageId,
+			Text:      record.Render(),
+			ParseMode: parseMode,
+		})
+		if err == nil || IsNotModified(err) {
+			return nil
+		}
+		if !IsMessageNotFound(err) {
+			return err
+		}
+		logrus.Warnf("can't edit message %d of %s, posting new one: %v", record.MessageId, item, err)
+	}
+	message, err := w.Bot.Send(SendMessageRequest{
+		ChatId:          record.ChatId,
+		MessageThreadId: record.ThreadId,
+		Text:            record.Render(),
+		ParseMode:       parseMode,
+	})
+	if err != nil {
+		return err
+	}
+	return w.Messages.Update(item.ProjectId, item.Iid, func(record *MessageRecord, found bool) (bool, error) {
+		record.MessageId = message.MessageID
+		return found, nil
+	})
+}
@@ -0,0 +1,173 @@
+package notifier
+
+import (
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func pendingIds(o *Outbox) []uint64 {
+	ids := make([]uint64, 0)
+	for _, item := range o.Pending() {
+		ids = append(ids, item.Id)
+	}
+	return ids
+}
+
+func TestOpenOutboxReplay(t *testing.T) {
+	tests := []struct {
+		name    string
+		journal string
+		pending []uint64
+		nextId  uint64
+	}{
+		{"missing", "", []uint64{}, 1},
+		{"adds", `{"add":{"id":1,"kind":"announce"}}
+{"add":{"id":2,"kind":"reply"}}
+{"add":{"id":3,"kind":"announce"}}
+`, []uint64{1, 2, 3}, 4},
+		{"done", `{"add":{"id":1,"kind":"announce"}}
+{"add":{"id":2,"kind":"reply"}}
+{"done":1}
+{"add":{"id":3,"kind":"announce"}}
+{"done":3}
+`, []uint64{2}, 4},
+		{"all done", `{"add":{"id":5,"kind":"announce"}}
+{"done":5}
+`, []uint64{}, 6},
+		{"cut last line", `{"add":{"id":1,"kind":"announce"}}
+{"add":{"id":2,"kind":"reply"}}
+{"done":`, []uint64{1, 2}, 3},
+		{"broken line in the middle", `{"add":{"id":1,"kind":"announce"}}
+garbage
+{"add":{"id":2,"kind":"reply"}}
+`, []uint64{1, 2}, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "outbox.jsonl")
+			if test.journal != "" {
+				if err := ioutil.WriteFile(path, []byte(test.journal), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			o, err := OpenOutbox(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := pendingIds(o); !reflect.DeepEqual(got, test.pending) {
+				t.Errorf("pending %v, want %v", got, test.pending)
+			}
+			if err = o.Add(OutboxItem{Kind: OutboxReply}); err != nil {
+				t.Fatal(err)
+			}
+			want := append(append([]uint64(nil), test.pending...), test.nextId)
+			if got := pendingIds(o); !reflect.DeepEqual(got, want) {
+				t.Errorf("after add pending %v, want %v", got, want)
+			}
+			if err = o.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// the journal is compacted on open, so it holds pending items only
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lines := strings.Count(string(data), "\n"); lines != len(want) {
+				t.Errorf("journal has %d lines, want %d:\n%s", lines, len(want), data)
+			}
+			reopened, err := OpenOutbox(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.Close()
+			if got := pendingIds(reopened); !reflect.DeepEqual(got, want) {
+				t.Errorf("reopened pending %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// replyMessenger answers replies with errors by their text
+type replyMessenger struct {
+	Messenger
+	errors map[string]error
+	sent   []string
+}
+
+func (m *replyMessenger) Reply(messageId int, request SendMessageRequest) (tgbotapi.Message, error) {
+	if err := m.errors[request.Text]; err != nil {
+		return tgbotapi.Message{}, err
+	}
+	m.sent = append(m.sent, request.Text)
+	return tgbotapi.Message{MessageID: messageId + 1}, nil
+}
+
+func (m *replyMessenger) Send(request SendMessageRequest) (tgbotapi.Message, error) {
+	// admin reports
+	return tgbotapi.Message{}, nil
+}
+
+func TestOutboxDrain(t *testing.T) {
+	dir := t.TempDir()
+	messages, err := NewMessageStore(filepath.Join(dir, "messages.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for iid := 1; iid <= 2; iid++ {
+		err = messages.Update(1, iid, func(record *MessageRecord, found bool) (bool, error) {
+			*record = MessageRecord{ChatId: -1, MessageId: 100 * iid}
+			return true, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "outbox.jsonl")
+	o, err := OpenOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []struct {
+		iid  int
+		text string
+	}{
+		{1, "a1"}, {2, "b1"}, {1, "bad markup"}, {2, "telegram down"}, {1, "a2"}, {2, "b2"},
+	} {
+		if err = o.Add(OutboxItem{Kind: OutboxReply, ProjectId: 1, Iid: item.iid, Text: item.text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bot := &replyMessenger{errors: map[string]error{
+		"bad markup":    &Error{Method: "sendMessage", Code: http.StatusBadRequest, Description: "can't parse entities"},
+		"telegram down": &Error{Method: "sendMessage", Code: http.StatusBadGateway, Description: "Bad Gateway"},
+	}}
+	worker := NewOutboxWorker(o, bot, messages, func() int64 { return -2 })
+	worker.Drain()
+	if err = o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the permanent error drops the item, the temporary one holds the rest of its MR
+	if want := []string{"a1", "b1", "a2"}; !reflect.DeepEqual(bot.sent, want) {
+		t.Errorf("sent %v, want %v", bot.sent, want)
+	}
+	reopened, err := OpenOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	texts := make([]string, 0)
+	for _, item := range reopened.Pending() {
+		texts = append(texts, fmt.Sprintf("%d:%s", item.Iid, item.Text))
+	}
+	if want := []string{"2:telegram down", "2:b2"}; !reflect.DeepEqual(texts, want) {
+		t.Errorf("pending after restart %v, want %v", texts, want)
+	}
+}
@@ -0,0 +1,198 @@
+package notifier
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultConfigBackups = 5
+	backupTimeFormat     = "20060102-150405.000"
+	backupSuffix         = ".bak"
+)
+
+// writeFileAtomic writes data to a temp file next to the target and renames it into place
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	file, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := file.Name()
+	defer os.Remove(tmp)
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp, perm); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		if errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.EXDEV) {
+			// a file bind-mounted into a container can't be replaced, only rewritten
+			return writeFileInPlace(path, data)
+		}
+		return err
+	}
+	// the rename itself is durable once the directory is synced
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// writeFileInPlace truncates and rewrites the file keeping its inode
+func writeFileInPlace(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ListBackups returns config backups, the newest first
+func ListBackups(path string) ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(path) + "."
+	backups := make([]string, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, backupSuffix) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), backupSuffix)
+		if _, err := time.Parse(backupTimeFormat, stamp); err != nil {
+			continue
+		}
+		backups = append(backups, filepath.Join(filepath.Dir(path), name))
+	}
+	// the time format sorts lexically
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	return backups, nil
+}
+
+// BackupTime returns time of the backup taken from its name
+func BackupTime(backup string) time.Time {
+	name := strings.TrimSuffix(filepath.Base(backup), backupSuffix)
+	if len(name) < len(backupTimeFormat) {
+		return time.Time{}
+	}
+	t, _ := time.ParseInLocation(backupTimeFormat, name[len(name)-len(backupTimeFormat):], time.Local)
+	return t
+}
+
+// backupFile keeps the current content of the file as a timestamped backup, only keep newest backups are left
+func backupFile(path string, keep int) error {
+	if keep <= 0 {
+		keep = DefaultConfigBackups
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	backup := path + "." + time.Now().Format(backupTimeFormat) + backupSuffix
+	if err = writeFileAtomic(backup, data, info.Mode().Perm()); err != nil {
+		return err
+	}
+	backups, err := ListBackups(path)
+	if err != nil {
+		return err
+	}
+	for idx := keep; idx < len(backups); idx++ {
+		if err := os.Remove(backups[idx]); err != nil {
+			logrus.Errorf("can't remove old config backup: %v", err)
+		}
+	}
+	return nil
+}
+
+// persist writes the config snapshot unless a newer one is already written, the admin is told when writes start failing
+func (c *Config) persist(path string, data []byte, version uint64, keep int) error {
+	c.writeLock.Lock()
+	if version <= c.persisted {
+		c.writeLock.Unlock()
+		return nil
+	}
+	perm := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	err := backupFile(path, keep)
+	if err == nil {
+		err = writeFileAtomic(path, data, perm)
+	}
+	c.persisted = version
+	var report error
+	if err != nil {
+		logrus.Errorf("can't synchronize config: %v", err)
+		if !c.writeFailed {
+			report = fmt.Errorf("can't write config %s, changes are kept in memory only: %w", path, err)
+		}
+	} else {
+		if c.writeFailed {
+			logrus.Infof("config %s is written again", path)
+		}
+		c.written = sha256.Sum256(data)
+	}
+	c.writeFailed = err != nil
+	notify := c.onWriteFail
+	c.writeLock.Unlock()
+
+	if report != nil && notify != nil {
+		notify(report)
+	}
+	return err
+}
+
+// Restore replaces config with the valid backup, returns description of the changes
+func (c *Config) Restore(backup string) ([]string, error) {
+	data, err := ioutil.ReadFile(backup)
+	if err != nil {
+		return nil, err
+	}
+	var fresh Config
+	if err = LoadConfig(data, &fresh); err != nil {
+		return nil, fmt.Errorf("backup %s is invalid:\n%w", filepath.Base(backup), err)
+	}
+	unlock := c.FastLock()
+	changes := c.replace(&fresh)
+	c.version++
+	version, path, keep := c.version, c.syncPath, c.ConfigBackups
+	unlock()
+	return changes, c.persist(path, data, version, keep)
+}
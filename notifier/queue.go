@@ -0,0 +1,84 @@
+package notifier
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+const (
+	DefaultWorkers   = 4
+	DefaultQueueSize = 100
+)
+
+// Queue runs jobs on a pool of workers, jobs with the same key run in order on the same worker
+type Queue struct {
+	shards []chan func()
+	wg     sync.WaitGroup
+	lock   sync.RWMutex
+	closed bool
+}
+
+// NewQueue starts workers, size bounds the number of waiting jobs
+func NewQueue(workers int, size int) *Queue {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	perShard := (size + workers - 1) / workers
+	q := &Queue{shards: make([]chan func(), workers)}
+	for idx := range q.shards {
+		shard := make(chan func(), perShard)
+		q.shards[idx] = shard
+		q.wg.Add(1)
+		go q.work(shard)
+	}
+	return q
+}
+
+func (q *Queue) work(shard chan func()) {
+	defer q.wg.Done()
+	for job := range shard {
+		job()
+	}
+}
+
+// Push queues the job, false if the queue is full or closed
+func (q *Queue) Push(key string, job func()) bool {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	if q.closed {
+		return false
+	}
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key))
+	select {
+	case q.shards[hash.Sum32()%uint32(len(q.shards))] <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// Len is the number of waiting jobs
+func (q *Queue) Len() int {
+	length := 0
+	for _, shard := range q.shards {
+		length += len(shard)
+	}
+	return length
+}
+
+// Close stops accepting jobs and waits until queued ones are done
+func (q *Queue) Close() {
+	q.lock.Lock()
+	if !q.closed {
+		q.closed = true
+		for _, shard := range q.shards {
+			close(shard)
+		}
+	}
+	q.lock.Unlock()
+	q.wg.Wait()
+}
@@ -0,0 +1,71 @@
+package notifier
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueOrderPerKey(t *testing.T) {
+	q := NewQueue(4, 1000)
+	var lock sync.Mutex
+	done := make(map[string][]int)
+	for seq := 0; seq < 200; seq++ {
+		key, seq := fmt.Sprintf("1!%d", seq%7), seq
+		pause := time.Duration(rand.Intn(200)) * time.Microsecond
+		ok := q.Push(key, func() {
+			time.Sleep(pause)
+			lock.Lock()
+			done[key] = append(done[key], seq)
+			lock.Unlock()
+		})
+		if !ok {
+			t.Fatalf("job %d rejected", seq)
+		}
+	}
+	q.Close()
+	total := 0
+	for key, order := range done {
+		total += len(order)
+		for idx := 1; idx < len(order); idx++ {
+			if order[idx] < order[idx-1] {
+				t.Errorf("jobs of %s ran out of order: %v", key, order)
+				break
+			}
+		}
+	}
+	if total != 200 {
+		t.Errorf("%d jobs done, want 200", total)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	q := NewQueue(1, 2)
+	started, release := make(chan struct{}), make(chan struct{})
+	if !q.Push("a", func() {
+		close(started)
+		<-release
+	}) {
+		t.Fatal("first job rejected")
+	}
+	// the worker is busy, so next jobs wait in the queue
+	<-started
+	for idx := 0; idx < 2; idx++ {
+		if !q.Push("a", func() {}) {
+			t.Fatalf("job %d rejected before the queue is full", idx)
+		}
+	}
+	if q.Push("a", func() {}) {
+		t.Error("job accepted by full queue")
+	}
+	if q.Len() != 2 {
+		t.Errorf("queue length %d, want 2", q.Len())
+	}
+	close(release)
+	q.Close()
+	if q.Push("a", func() {}) {
+		t.Error("job accepted by closed queue")
+	}
+}
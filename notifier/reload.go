@@ -0,0 +1,300 @@
+package notifier
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const configWatchInterval = 5 * time.Second
+
+// restartKeys are read on start only
+var restartKeys = map[string]bool{
+	"telegram.bot-api":         true,
+	"telegram.api-url":         true,
+	"telegram.retry-attempts":  true,
+	"telegram.chat-rate-limit": true,
+	"web-hook-path":            true,
+	"web-hook-listen":          true,
+	"web-hook-port":            true,
+	"tls":                      true,
+	"admin-listen":             true,
+	"web-hook-workers":         true,
+	"web-hook-queue-size":      true,
+	"web-hook-max-body-size":   true,
+	"web-hook-read-timeout":    true,
+	"web-hook-write-timeout":   true,
+	"dedup-window":             true,
+	"dedup-store":              true,
+	"message-store":            true,
+	"outbox":                   true,
+}
+
+// readFile reads the config file, own is true if the bot wrote or loaded the content
+func (c *Config) readFile(path string) (data []byte, sum [sha256.Size]byte, own bool, err error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		return nil, sum, false, err
+	}
+	sum = sha256.Sum256(data)
+	return data, sum, sum == c.written, nil
+}
+
+// apply swaps config values with the fresh ones read from the file, returns description of the changes
+func (c *Config) apply(fresh *Config, sum [sha256.Size]byte) []string {
+	defer (c.FastLock())()
+	changes := c.replace(fresh)
+	c.writeLock.Lock()
+	c.written = sum
+	c.writeLock.Unlock()
+	return changes
+}
+
+// isRestartKey is true for keys read on start only
+func isRestartKey(key string) bool {
+	return restartKeys[key] || restartKeys[strings.Split(key, ".")[0]]
+}
+
+// replace swaps config values with the fresh ones, must be called under lock.
+// keys read on start only keep the running values, the fresh ones are written to the file until restart
+func (c *Config) replace(fresh *Config) []string {
+	changes := diffConfig(c, fresh)
+	dst := reflect.ValueOf(c).Elem()
+	src := reflect.ValueOf(fresh).Elem()
+	running := make(map[string]reflect.Value)
+	configLeaves(dst.Type(), "", nil, func(key string, index []int, field reflect.StructField) {
+		if isRestartKey(key) {
+			value := reflect.New(field.Type).Elem()
+			value.Set(dst.FieldByIndex(index))
+			running[key] = value
+		}
+	})
+	for idx := 0; idx < dst.NumField(); idx++ {
+		// lock and sync state are kept
+		if dst.Type().Field(idx).PkgPath == "" {
+			dst.Field(idx).Set(src.Field(idx))
+		}
+	}
+	c.overrides = fresh.overrides
+	c.pending = make(map[string]envOverride)
+	configLeaves(dst.Type(), "", nil, func(key string, index []int, field reflect.StructField) {
+		value, ok := running[key]
+		if !ok {
+			return
+		}
+		file := reflect.New(field.Type).Elem()
+		file.Set(src.FieldByIndex(index))
+		if override, ok := fresh.overrides[key]; ok {
+			file = override.file
+		}
+		dst.FieldByIndex(index).Set(value)
+		c.pending[key] = envOverride{index: index, file: file}
+	})
+	return changes
+}
+
+func yamlName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if name == "" {
+		return strings.ToLower(field.Name)
+	}
+	return name
+}
+
+// changedKeys lists yaml keys of exported fields which differ, nested structs are compared by their fields
+func changedKeys(old *Config, fresh *Config) []string {
+	keys := make([]string, 0)
+	oldValue, freshValue := reflect.ValueOf(old).Elem(), reflect.ValueOf(fresh).Elem()
+	configLeaves(oldValue.Type(), "", nil, func(key string, index []int, field reflect.StructField) {
+		if !reflect.DeepEqual(oldValue.FieldByIndex(index).Interface(), freshValue.FieldByIndex(index).Interface()) {
+			keys = append(keys, key)
+		}
+	})
+	return keys
+}
+
+func diffConfig(old *Config, fresh *Config) []string {
+	changes := make([]string, 0)
+
+	oldProjects := make(map[string]ProjectInfo)
+	for _, project := range old.Projects {
+		oldProjects[project.Project] = project
+	}
+	freshProjects := make(map[string]bool)
+	for _, project := range fresh.Projects {
+		freshProjects[project.Project] = true
+		previous, ok := oldProjects[project.Project]
+		if !ok {
+			changes = append(changes, "project added: "+project.Project)
+			continue
+		}
+		if diff := diffLists(previous.Reviewers, project.Reviewers); diff != "" {
+			changes = append(changes, fmt.Sprintf("reviewers of %s: %s", project.Project, diff))
+		}
+		if !reflect.DeepEqual(previous.Actions, project.Actions) ||
+			!reflect.DeepEqual(previous.Templates, project.Templates) ||
+			previous.Secret != project.Secret {
+			changes = append(changes, "settings of "+project.Project)
+		}
+	}
+	for _, project := range old.Projects {
+		if !freshProjects[project.Project] {
+			changes = append(changes, "project removed: "+project.Project)
+		}
+	}
+
+	oldReviewers := make([]string, 0, len(old.Reviewers))
+	for _, reviewer := range old.Reviewers {
+		oldReviewers = append(oldReviewers, reviewer.Key())
+	}
+	freshReviewers := make([]string, 0, len(fresh.Reviewers))
+	for _, reviewer := range fresh.Reviewers {
+		freshReviewers = append(freshReviewers, reviewer.Key())
+	}
+	if diff := diffLists(oldReviewers, freshReviewers); diff != "" {
+		changes = append(changes, "reviewers: "+diff)
+	} else if !reflect.DeepEqual(old.Reviewers, fresh.Reviewers) {
+		changes = append(changes, "reviewers details")
+	}
+
+	other := make([]string, 0)
+	restart := make([]string, 0)
+	for _, key := range changedKeys(old, fresh) {
+		switch {
+		case key == "projects" || key == "reviewers":
+		case isRestartKey(key):
+			restart = append(restart, key)
+		default:
+			other = append(other, key)
+		}
+	}
+	if len(other) > 0 {
+		changes = append(changes, "changed: "+strings.Join(other, ", "))
+	}
+	if len(restart) > 0 {
+		changes = append(changes, "restart needed to apply: "+strings.Join(restart, ", "))
+	}
+	return changes
+}
+
+// diffLists returns "+added, -removed" of two lists
+func diffLists(old []string, fresh []string) string {
+	present := make(map[string]bool)
+	for _, item := range old {
+		present[item] = true
+	}
+	diff := make([]string, 0)
+	kept := make(map[string]bool)
+	for _, item := range fresh {
+		kept[item] = true
+		if !present[item] {
+			diff = append(diff, "+"+item)
+		}
+	}
+	for _, item := range old {
+		if !kept[item] {
+			diff = append(diff, "-"+item)
+		}
+	}
+	sort.Strings(diff)
+	return strings.Join(diff, ", ")
+}
+
+// ConfigWatcher reloads the config file edited by hand
+type ConfigWatcher struct {
+	path   string
+	config *Config
+	bot    Messenger
+
+	lock     sync.Mutex
+	lastSeen [sha256.Size]byte
+	modTime  time.Time
+	size     int64
+}
+
+func NewConfigWatcher(path string, config *Config, bot Messenger) *ConfigWatcher {
+	w := &ConfigWatcher{
+		path:   path,
+		config: config,
+		bot:    bot,
+	}
+	if info, err := os.Stat(path); err == nil {
+		w.modTime, w.size = info.ModTime(), info.Size()
+	}
+	if data, err := ioutil.ReadFile(path); err == nil {
+		w.lastSeen = sha256.Sum256(data)
+	}
+	return w
+}
+
+// Watch polls the file until stop is closed
+func (w *ConfigWatcher) Watch(stop <-chan struct{}) {
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(w.path)
+		if err != nil {
+			logrus.Errorf("can't watch config %s: %v", w.path, err)
+			continue
+		}
+		w.lock.Lock()
+		changed := !info.ModTime().Equal(w.modTime) || info.Size() != w.size
+		w.modTime, w.size = info.ModTime(), info.Size()
+		w.lock.Unlock()
+		if changed {
+			w.Reload()
+		}
+	}
+}
+
+// Reload validates the file and applies it, the admin chat is told about the result
+func (w *ConfigWatcher) Reload() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	data, sum, own, err := w.config.readFile(w.path)
+	if err != nil {
+		logrus.Errorf("can't read config %s: %v", w.path, err)
+		return
+	}
+	if own || sum == w.lastSeen {
+		logrus.Debugf("config %s is not changed by hand", w.path)
+		w.lastSeen = sum
+		return
+	}
+	w.lastSeen = sum
+
+	var fresh Config
+	if err = LoadConfig(data, &fresh); err != nil {
+		logrus.Errorf("config %s is not reloaded: %v", w.path, err)
+		w.notifyAdmin(fmt.Sprintf("config is not reloaded, the current one is kept:\n%v", err))
+		return
+	}
+	changes := w.config.apply(&fresh, sum)
+	logrus.Infof("config %s reloaded: %v", w.path, changes)
+	if len(changes) == 0 {
+		w.notifyAdmin("config reloaded, nothing changed")
+		return
+	}
+	w.notifyAdmin("config reloaded:\n- " + strings.Join(changes, "\n- "))
+}
+
+func (w *ConfigWatcher) notifyAdmin(text string) {
+	_, err := w.bot.Send(SendMessageRequest{ChatId: w.config.AdminChat(), Text: text})
+	if err != nil {
+		logrus.Errorf("can't notify admin: %v", err)
+	}
+}
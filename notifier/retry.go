@@ -0,0 +1,171 @@
+package notifier
+
+import (
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/sirupsen/logrus"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRetryAttempts = 5
+	// DefaultChatRateLimit keeps under telegram limit of 20 messages per minute in groups
+	DefaultChatRateLimit = 20
+	// globalRateInterval keeps under telegram limit of 30 messages per second
+	globalRateInterval = time.Second / 30
+)
+
+type RetryPolicy struct {
+	Attempts   int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:   DefaultRetryAttempts,
+	MinBackoff: time.Second,
+	MaxBackoff: 30 * time.Second,
+}
+
+// backoff is exponential delay before the attempt (starting from 1) with jitter
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.MinBackoff << uint(attempt-1)
+	if delay > p.MaxBackoff || delay <= 0 {
+		delay = p.MaxBackoff
+	}
+	// jitter: 50-100% of the delay
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// isRetryable is true for network errors, 5xx and 429
+func isRetryable(err error) bool {
+	apiErr, ok := asTelegramError(err)
+	if !ok {
+		return true
+	}
+	return apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= http.StatusInternalServerError
+}
+
+// RateLimiter spreads sends to the same group or channel over time, private chats (positive ids)
+// and chats Exempt returns true for are limited by the global rate only
+type RateLimiter struct {
+	Exempt       func(chatId int64) bool
+	chatInterval time.Duration
+	lock         sync.Mutex
+	next         map[int64]time.Time
+	nextGlobal   time.Time
+}
+
+func NewRateLimiter(messagesPerMinute int) *RateLimiter {
+	if messagesPerMinute <= 0 {
+		messagesPerMinute = DefaultChatRateLimit
+	}
+	return &RateLimiter{
+		chatInterval: time.Minute / time.Duration(messagesPerMinute),
+		next:         make(map[int64]time.Time),
+	}
+}
+
+// Wait blocks until the chat may receive next message
+func (l *RateLimiter) Wait(chatId int64) {
+	// asked before locking, Exempt may take other locks
+	limited := chatId < 0 && (l.Exempt == nil || !l.Exempt(chatId))
+	l.lock.Lock()
+	now := time.Now()
+	slot := now
+	if l.next[chatId].After(slot) {
+		slot = l.next[chatId]
+	}
+	if l.nextGlobal.After(slot) {
+		slot = l.nextGlobal
+	}
+	if limited {
+		l.next[chatId] = slot.Add(l.chatInterval)
+	}
+	l.nextGlobal = slot.Add(globalRateInterval)
+	l.lock.Unlock()
+
+	if delay := slot.Sub(now); delay > 0 {
+		logrus.Debugf("rate limit: waiting %v before sending to %d", delay, chatId)
+		time.Sleep(delay)
+	}
+}
+
+// Pause holds sends to the chat for exactly the duration telegram asked to retry after
+func (l *RateLimiter) Pause(chatId int64, duration time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.next[chatId] = time.Now().Add(duration)
+}
+
+// RetryingMessenger retries failed calls of wrapped Messenger and rate limits them per chat
+type RetryingMessenger struct {
+	Messenger
+	policy  RetryPolicy
+	limiter *RateLimiter
+}
+
+func NewRetryingMessenger(messenger Messenger, policy RetryPolicy, limiter *RateLimiter) *RetryingMessenger {
+	if policy.Attempts <= 0 {
+		policy.Attempts = DefaultRetryAttempts
+	}
+	return &RetryingMessenger{
+		Messenger: messenger,
+		policy:    policy,
+		limiter:   limiter,
+	}
+}
+
+func (r *RetryingMessenger) do(chatId int64, method string, call func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		r.limiter.Wait(chatId)
+		err = call()
+		if err == nil || !isRetryable(err) || attempt >= r.policy.Attempts {
+			return err
+		}
+		if apiErr, ok := asTelegramError(err); ok && apiErr.RetryAfter > 0 {
+			// telegram knows better, limiter makes the whole chat wait
+			logrus.Warnf("%s to %d failed (attempt %d/%d): %v, retrying in %v",
+				method, chatId, attempt, r.policy.Attempts, err, apiErr.RetryAfter)
+			r.limiter.Pause(chatId, apiErr.RetryAfter)
+			continue
+		}
+		delay := r.policy.backoff(attempt)
+		logrus.Warnf("%s to %d failed (attempt %d/%d): %v, retrying in %v",
+			method, chatId, attempt, r.policy.Attempts, err, delay)
+		time.Sleep(delay)
+	}
+}
+
+func (r *RetryingMessenger) Send(request SendMessageRequest) (tgbotapi.Message, error) {
+	var message tgbotapi.Message
+	err := r.do(request.ChatId, "sendMessage", func() (err error) {
+		message, err = r.Messenger.Send(request)
+		return err
+	})
+	return message, err
+}
+
+func (r *RetryingMessenger) Reply(messageId int, request SendMessageRequest) (tgbotapi.Message, error) {
+	var message tgbotapi.Message
+	err := r.do(request.ChatId, "sendMessage", func() (err error) {
+		message, err = r.Messenger.Reply(messageId, request)
+		return err
+	})
+	return message, err
+}
+
+func (r *RetryingMessenger) Edit(request EditMessageTextRequest) error {
+	return r.do(request.ChatId, "editMessageText", func() error {
+		return r.Messenger.Edit(request)
+	})
+}
+
+func (r *RetryingMessenger) Delete(chatId int64, messageId int) error {
+	return r.do(chatId, "deleteMessage", func() error {
+		return r.Messenger.Delete(chatId, messageId)
+	})
+}
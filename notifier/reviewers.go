@@ -0,0 +1,90 @@
+package notifier
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"strings"
+)
+
+// Reviewer links gitlab identity with telegram one
+type Reviewer struct {
+	GitLabUsername   string `yaml:"gitlab-username,omitempty"`
+	GitLabUserId     int    `yaml:"gitlab-user-id,omitempty"`
+	TelegramUsername string `yaml:"telegram-username,omitempty"`
+	TelegramUserId   int64  `yaml:"telegram-user-id,omitempty"`
+	DisplayName      string `yaml:"display-name,omitempty"`
+}
+
+// ParseReviewer converts old plain string reviewer ('@user' or name) to Reviewer
+func ParseReviewer(reviewer string) Reviewer {
+	reviewer = strings.TrimSpace(reviewer)
+	if strings.HasPrefix(reviewer, "@") {
+		return Reviewer{TelegramUsername: strings.TrimPrefix(reviewer, "@")}
+	}
+	return Reviewer{DisplayName: reviewer}
+}
+
+func (r *Reviewer) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		// backward compatibility: reviewers used to be plain strings
+		var plain string
+		if err := value.Decode(&plain); err != nil {
+			return err
+		}
+		*r = ParseReviewer(plain)
+		return nil
+	}
+	// node decoding doesn't know about strict mode, so unknown keys are checked here
+	var unknown []string
+	for idx := 0; idx+1 < len(value.Content); idx += 2 {
+		key := value.Content[idx]
+		if !reviewerKeys[key.Value] {
+			unknown = append(unknown, fmt.Sprintf("line %d: field %s not found in type notifier.Reviewer", key.Line, key.Value))
+		}
+	}
+	if len(unknown) > 0 {
+		return &yaml.TypeError{Errors: unknown}
+	}
+	type reviewer Reviewer
+	return value.Decode((*reviewer)(r))
+}
+
+var reviewerKeys = map[string]bool{
+	"gitlab-username":   true,
+	"gitlab-user-id":    true,
+	"telegram-username": true,
+	"telegram-user-id":  true,
+	"display-name":      true,
+}
+
+// Key identifies the reviewer in project reviewers lists
+func (r Reviewer) Key() string {
+	switch {
+	case r.TelegramUsername != "":
+		return "@" + r.TelegramUsername
+	case r.GitLabUsername != "":
+		return r.GitLabUsername
+	case r.DisplayName != "":
+		return r.DisplayName
+	}
+	return fmt.Sprintf("tg:%d", r.TelegramUserId)
+}
+
+func (r Reviewer) Name() string {
+	switch {
+	case r.DisplayName != "":
+		return r.DisplayName
+	case r.TelegramUsername != "":
+		return "@" + r.TelegramUsername
+	case r.GitLabUsername != "":
+		return r.GitLabUsername
+	}
+	return r.Key()
+}
+
+func (r Reviewer) isGitLabUser(username string, userId int) bool {
+	if userId != 0 && r.GitLabUserId == userId {
+		return true
+	}
+	return username != "" && r.GitLabUsername == username
+}
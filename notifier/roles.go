@@ -0,0 +1,78 @@
+package notifier
+
+const (
+	// RoleOwner edits everything
+	RoleOwner = "owner"
+	// RoleMaintainer edits reviewers of own projects
+	RoleMaintainer = "maintainer"
+	// RoleViewer lists only
+	RoleViewer = "viewer"
+)
+
+var roles = []string{RoleOwner, RoleMaintainer, RoleViewer}
+
+// Admin is a telegram user allowed to manage the bot from the admin chat or a private chat with the bot
+type Admin struct {
+	UserId int64  `yaml:"user-id"`
+	Name   string `yaml:"name,omitempty"`
+	Role   string `yaml:"role"`
+	// Projects of a maintainer
+	Projects []string `yaml:"projects,omitempty"`
+}
+
+// Caller is the user running a command and the chat to answer to
+type Caller struct {
+	UserId   int64
+	ChatId   int64
+	Role     string
+	Projects []string
+}
+
+func (c *Caller) IsOwner() bool {
+	return c.Role == RoleOwner
+}
+
+func (c *Caller) CanEditProject(project string) bool {
+	switch c.Role {
+	case RoleOwner:
+		return true
+	case RoleMaintainer:
+		for _, owned := range c.Projects {
+			if owned == project {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CanEditSome is true if the caller edits at least one project
+func (c *Caller) CanEditSome() bool {
+	return c.Role == RoleOwner || c.Role == RoleMaintainer && len(c.Projects) > 0
+}
+
+// Caller returns the role of the user writing to the chat, ok is false for strangers and other chats.
+// without admins listed everybody in the admin chat is an owner
+func (c *Config) Caller(userId int64, chatId int64, private bool) (caller *Caller, ok bool) {
+	defer (c.FastLock())()
+	if chatId != c.Telegram.AdminChatId && !private {
+		return nil, false
+	}
+	if len(c.Admins) == 0 {
+		if chatId != c.Telegram.AdminChatId {
+			return nil, false
+		}
+		return &Caller{UserId: userId, ChatId: chatId, Role: RoleOwner}, true
+	}
+	for _, admin := range c.Admins {
+		if admin.UserId == userId {
+			return &Caller{
+				UserId:   userId,
+				ChatId:   chatId,
+				Role:     admin.Role,
+				Projects: append([]string(nil), admin.Projects...),
+			}, true
+		}
+	}
+	return nil, false
+}
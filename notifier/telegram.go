@@ -0,0 +1,282 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultApiUrl = "https://api.telegram.org"
+
+type SendMessageRequest struct {
+	ChatId                int64       `json:"chat_id"`
+	MessageThreadId       int64       `json:"message_thread_id,omitempty"`
+	ReplyToMessageId      int         `json:"reply_to_message_id,omitempty"`
+	Text                  string      `json:"text"`
+	ParseMode             string      `json:"parse_mode,omitempty"`
+	DisableWebPagePreview bool        `json:"disable_web_page_preview,omitempty"`
+	ReplyMarkup           interface{} `json:"reply_markup,omitempty"`
+}
+
+type EditMessageTextRequest struct {
+	ChatId      int64                          `json:"chat_id"`
+	MessageId   int                            `json:"message_id"`
+	Text        string                         `json:"text"`
+	ParseMode   string                         `json:"parse_mode,omitempty"`
+	ReplyMarkup *tgbotapi.InlineKeyboardMarkup `json:"reply_markup,omitempty"`
+}
+
+type deleteMessageRequest struct {
+	ChatId    int64 `json:"chat_id"`
+	MessageId int   `json:"message_id"`
+}
+
+type answerCallbackRequest struct {
+	CallbackQueryId string `json:"callback_query_id"`
+	Text            string `json:"text,omitempty"`
+}
+
+type getUpdatesRequest struct {
+	Offset  int `json:"offset,omitempty"`
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// Messenger is the only way the bot talks to telegram
+type Messenger interface {
+	Send(request SendMessageRequest) (tgbotapi.Message, error)
+	// Reply sends the message as a reply to messageId in the same chat/thread
+	Reply(messageId int, request SendMessageRequest) (tgbotapi.Message, error)
+	Edit(request EditMessageTextRequest) error
+	Delete(chatId int64, messageId int) error
+	AnswerCallback(callbackQueryId string, text string) error
+}
+
+// Error is an error returned by telegram Bot API
+type Error struct {
+	Method      string
+	Code        int
+	Description string
+	// RetryAfter is set on 429 Too Many Requests
+	RetryAfter time.Duration
+	// MigrateToChatId is set when group was upgraded to supergroup
+	MigrateToChatId int64
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s failed: %d %s", e.Method, e.Code, e.Description)
+}
+
+func asTelegramError(err error) (*Error, bool) {
+	var apiErr *Error
+	ok := errors.As(err, &apiErr)
+	return apiErr, ok
+}
+
+func IsNotModified(err error) bool {
+	apiErr, ok := asTelegramError(err)
+	return ok && apiErr.Code == http.StatusBadRequest && strings.Contains(apiErr.Description, "message is not modified")
+}
+
+func IsMessageNotFound(err error) bool {
+	apiErr, ok := asTelegramError(err)
+	return ok && apiErr.Code == http.StatusBadRequest &&
+		(strings.Contains(apiErr.Description, "message to edit not found") ||
+			strings.Contains(apiErr.Description, "message to delete not found") ||
+			strings.Contains(apiErr.Description, "message can't be edited"))
+}
+
+func IsTooManyRequests(err error) bool {
+	apiErr, ok := asTelegramError(err)
+	return ok && apiErr.Code == http.StatusTooManyRequests
+}
+
+// BotAPI is Messenger talking to Bot API server at apiUrl
+type BotAPI struct {
+	token  string
+	apiUrl string
+	client *http.Client
+
+	lock       sync.Mutex
+	stopPollFn context.CancelFunc
+	lastPoll   time.Time
+}
+
+func NewBotAPI(token string, apiUrl string) *BotAPI {
+	if apiUrl == "" {
+		apiUrl = DefaultApiUrl
+	}
+	return &BotAPI{
+		token:  token,
+		apiUrl: strings.TrimRight(apiUrl, "/"),
+		client: &http.Client{Timeout: 90 * time.Second},
+	}
+}
+
+// Call executes Bot API method, result is decoded if not nil
+func (b *BotAPI) Call(ctx context.Context, method string, request interface{}, result interface{}) error {
+	start := time.Now()
+	err := b.call(ctx, method, request, result)
+	if ctx.Err() != nil {
+		// cancelled on shutdown
+		return err
+	}
+	TelegramRequestDuration.Observe(time.Since(start).Seconds(), method)
+	if err != nil {
+		code := "network"
+		if apiErr, ok := asTelegramError(err); ok {
+			code = strconv.Itoa(apiErr.Code)
+		}
+		TelegramErrors.Inc(method, code)
+	}
+	return err
+}
+
+func (b *BotAPI) call(ctx context.Context, method string, request interface{}, result interface{}) error {
+	logrus.Debugf("creating %s request from: %v", method, request)
+	var buf bytes.Buffer
+	err := json.NewEncoder(&buf).Encode(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx,
+		http.MethodPost, fmt.Sprintf("%s/bot%s/%s", b.apiUrl, b.token, method), &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		// don't leak the token from url into logs
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("%s request failed: %w", method, err)
+	}
+	defer resp.Body.Close()
+	responseData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("%s response: %s", method, responseData)
+	var response tgbotapi.APIResponse
+	err = json.Unmarshal(responseData, &response)
+	if err != nil {
+		return &Error{Method: method, Code: resp.StatusCode, Description: fmt.Sprintf("bad response: %v", err)}
+	}
+	if !response.Ok {
+		apiErr := &Error{Method: method, Code: response.ErrorCode, Description: response.Description}
+		if apiErr.Code == 0 {
+			apiErr.Code = resp.StatusCode
+		}
+		if response.Parameters != nil {
+			apiErr.RetryAfter = time.Duration(response.Parameters.RetryAfter) * time.Second
+			apiErr.MigrateToChatId = response.Parameters.MigrateToChatID
+		}
+		return apiErr
+	}
+	if result != nil {
+		return json.Unmarshal(response.Result, result)
+	}
+	return nil
+}
+
+func (b *BotAPI) Send(request SendMessageRequest) (tgbotapi.Message, error) {
+	var message tgbotapi.Message
+	err := b.Call(context.Background(), "sendMessage", request, &message)
+	return message, err
+}
+
+func (b *BotAPI) Reply(messageId int, request SendMessageRequest) (tgbotapi.Message, error) {
+	request.ReplyToMessageId = messageId
+	return b.Send(request)
+}
+
+func (b *BotAPI) Edit(request EditMessageTextRequest) error {
+	return b.Call(context.Background(), "editMessageText", request, nil)
+}
+
+func (b *BotAPI) Delete(chatId int64, messageId int) error {
+	return b.Call(context.Background(), "deleteMessage", deleteMessageRequest{ChatId: chatId, MessageId: messageId}, nil)
+}
+
+func (b *BotAPI) AnswerCallback(callbackQueryId string, text string) error {
+	return b.Call(context.Background(), "answerCallbackQuery",
+		answerCallbackRequest{CallbackQueryId: callbackQueryId, Text: text}, nil)
+}
+
+func (b *BotAPI) GetMe() (tgbotapi.User, error) {
+	var user tgbotapi.User
+	err := b.Call(context.Background(), "getMe", struct{}{}, &user)
+	return user, err
+}
+
+func (b *BotAPI) GetUpdates(ctx context.Context, offset int, timeout int) ([]tgbotapi.Update, error) {
+	var updates []tgbotapi.Update
+	err := b.Call(ctx, "getUpdates", getUpdatesRequest{Offset: offset, Timeout: timeout}, &updates)
+	return updates, err
+}
+
+// GetUpdatesChan long polls updates until StopReceivingUpdates is called
+func (b *BotAPI) GetUpdatesChan(offset int, timeout int) tgbotapi.UpdatesChannel {
+	ctx, cancel := context.WithCancel(context.Background())
+	b.lock.Lock()
+	b.stopPollFn = cancel
+	b.lock.Unlock()
+
+	updatesChan := make(chan tgbotapi.Update, 100)
+	go func() {
+		defer close(updatesChan)
+		for ctx.Err() == nil {
+			updates, err := b.GetUpdates(ctx, offset, timeout)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				logrus.Errorf("can't get updates: %v, retrying in 3 seconds...", err)
+				select {
+				case <-time.After(3 * time.Second):
+				case <-ctx.Done():
+				}
+				continue
+			}
+			b.lock.Lock()
+			b.lastPoll = time.Now()
+			b.lock.Unlock()
+			for _, update := range updates {
+				if update.UpdateID >= offset {
+					offset = update.UpdateID + 1
+					updatesChan <- update
+				}
+			}
+		}
+	}()
+	return updatesChan
+}
+
+// LastPoll is time of the last successful getUpdates
+func (b *BotAPI) LastPoll() time.Time {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.lastPoll
+}
+
+func (b *BotAPI) StopReceivingUpdates() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.stopPollFn != nil {
+		b.stopPollFn()
+		b.stopPollFn = nil
+	}
+}
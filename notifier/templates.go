@@ -0,0 +1,125 @@
+package notifier
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+)
+
+const (
+	// TemplateMergeRequest renders MR announcement
+	TemplateMergeRequest = "merge_request"
+	// TemplateMergeRequestChange renders changelog entry of MR announcement
+	TemplateMergeRequestChange = "merge_request_change"
+	TemplatePipeline           = "pipeline"
+	TemplateNote               = "note"
+)
+
+// DefaultTemplates escape all literal text, so they are valid for any parse mode
+var DefaultTemplates = map[string]string{
+	TemplateMergeRequest: `{{ escape "#MR" }} {{ bold .ObjectAttributes.Title }}
+project: {{ link .Project.WebURL .Project.PathWithNamespace }}
+by: {{ mention .Author }}
+route: {{ code .ObjectAttributes.SourceBranch }} → {{ code .ObjectAttributes.TargetBranch }}
+link: {{ link .ObjectAttributes.URL (printf "!%d" .ObjectAttributes.Iid) }}
+{{- with .ObjectAttributes.Labels }}
+labels: {{ labels . | escape }}{{ end }}
+{{- with .ObjectAttributes.Description }}
+description: {{ truncate 500 . | escape }}{{ end }}
+{{- with .Reviewers }}
+reviewers: {{ mentions . }}{{ end }}
+{{- with .Assignees }}
+assignees: {{ mentions . }}{{ end }}`,
+
+	TemplateMergeRequestChange: `{{ .Time.Format "02.01 15:04" | escape }} {{ with .ObjectAttributes.Action -}}
+{{ if eq . "update" }}updated{{ else if eq . "reopen" }}reopened{{ else if eq . "approved" }}approved
+{{- else if eq . "unapproved" }}approval revoked{{ else if eq . "merge" }}merged{{ else if eq . "close" }}closed
+{{- else }}{{ escape . }}{{ end }}{{ end }} by {{ mention .By }}
+{{- with .Updates }}: {{ join . "; " | escape }}{{ end }}`,
+
+	TemplatePipeline: `{{ link .Link (printf "pipeline #%d" .ObjectAttributes.ID) }} {{ bold .ObjectAttributes.Status }}
+ref: {{ code .ObjectAttributes.Ref }}
+{{- if eq .ObjectAttributes.Status "failed" }}
+{{ mention .Author }}{{ end }}`,
+
+	TemplateNote: `{{ mention .Commenter }} {{ link .ObjectAttributes.URL "commented" }}:
+{{- with .ObjectAttributes.Position }}
+{{ if .NewPath }}{{ code (printf "%s:%d" .NewPath .NewLine) }}{{ else }}{{ code (printf "%s:%d" .OldPath .OldLine) }}{{ end }}{{ end }}
+{{ .ObjectAttributes.Note | truncate 300 | forward }}
+{{- with .CC }}
+cc: {{ mentions . }}{{ end }}`,
+}
+
+// Truncate cuts text to maxRunes runes adding ellipsis
+func Truncate(maxRunes int, text string) string {
+	runes := []rune(text)
+	if len(runes) <= maxRunes {
+		return text
+	}
+	return string(runes[:maxRunes]) + "…"
+}
+
+// Mentions joins unique mentions of people
+func Mentions(f Formatter, people []Reviewer) string {
+	seen := make(map[string]struct{})
+	links := make([]string, 0, len(people))
+	for _, person := range people {
+		if _, ok := seen[person.Key()]; ok {
+			continue
+		}
+		seen[person.Key()] = struct{}{}
+		links = append(links, f.Mention(person))
+	}
+	return strings.Join(links, ", ")
+}
+
+func templateFuncs(f Formatter) template.FuncMap {
+	return template.FuncMap{
+		"truncate": Truncate,
+		"join":     strings.Join,
+		"escape":   f.Escape,
+		"bold":     f.Bold,
+		"italic":   f.Italic,
+		"code":     f.Code,
+		"link":     f.Link,
+		"mention":  f.Mention,
+		"mentions": func(people []Reviewer) string {
+			return Mentions(f, people)
+		},
+	}
+}
+
+// RenderTemplate executes text/template with helpers for the parse mode, extra helpers may override them.
+// Result is cut to the telegram message limit
+func RenderTemplate(name string, text string, f Formatter, funcs template.FuncMap, data interface{}) (string, error) {
+	tmpl := template.New(name).Funcs(templateFuncs(f))
+	if funcs != nil {
+		tmpl = tmpl.Funcs(funcs)
+	}
+	tmpl, err := tmpl.Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+	return f.Fit(strings.TrimSpace(buf.String()), MaxMessageLength), nil
+}
+
+// GetTemplate returns project template, global one or the default
+func (c *Config) GetTemplate(project string, event string) string {
+	defer (c.FastLock())()
+	for idx := range c.Projects {
+		if c.Projects[idx].Project == project {
+			if text, ok := c.Projects[idx].Templates[event]; ok {
+				return text
+			}
+		}
+	}
+	if text, ok := c.Templates[event]; ok {
+		return text
+	}
+	return DefaultTemplates[event]
+}
@@ -0,0 +1,158 @@
+package notifier
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const tlsWatchInterval = 30 * time.Second
+
+// TLSReloader serves certificate (and client CA) reloaded from files without restart
+type TLSReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	clientName   string
+
+	lock      sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTime   time.Time
+}
+
+// NewTLSReloader loads certificate and key, with clientCAFile set clients must present certificate
+// signed by the CA (and having clientName if not empty)
+func NewTLSReloader(certFile string, keyFile string, clientCAFile string, clientName string) (*TLSReloader, error) {
+	r := &TLSReloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		clientName:   clientName,
+	}
+	return r, r.Reload()
+}
+
+func (r *TLSReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		files = append(files, r.clientCAFile)
+	}
+	return files
+}
+
+// lastModified is the latest modification time of the files
+func (r *TLSReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Reload reads the files, the old certificate is kept on error
+func (r *TLSReloader) Reload() error {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("can't load certificate: %w", err)
+	}
+	var clientCAs *x509.CertPool
+	if r.clientCAFile != "" {
+		data, err := ioutil.ReadFile(r.clientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates in %s", r.clientCAFile)
+		}
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTime = modTime
+	logrus.Infof("tls certificate %s loaded", r.certFile)
+	return nil
+}
+
+// Watch reloads the files when they change
+func (r *TLSReloader) Watch(stop <-chan struct{}) {
+	ticker := time.NewTicker(tlsWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		modTime, err := r.lastModified()
+		r.lock.RLock()
+		changed := err == nil && modTime.After(r.modTime)
+		r.lock.RUnlock()
+		if !changed {
+			continue
+		}
+		if err = r.Reload(); err != nil {
+			logrus.Errorf("can't reload tls certificate: %v", err)
+		}
+	}
+}
+
+// TLSConfig returns server config using the current files on every handshake
+func (r *TLSReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// http.ServeTLS before go 1.21 loads certificate files unless Certificates or GetCertificate is set
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			r.lock.RLock()
+			defer r.lock.RUnlock()
+			return r.cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.lock.RLock()
+			defer r.lock.RUnlock()
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+			}
+			if r.clientCAs != nil {
+				config.ClientCAs = r.clientCAs
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+				config.VerifyConnection = r.verifyClientName
+			}
+			return config, nil
+		},
+	}
+}
+
+func (r *TLSReloader) verifyClientName(state tls.ConnectionState) error {
+	if r.clientName == "" {
+		return nil
+	}
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("no client certificate")
+	}
+	client := state.PeerCertificates[0]
+	if client.Subject.CommonName == r.clientName || client.VerifyHostname(r.clientName) == nil {
+		return nil
+	}
+	logrus.Warnf("client certificate %q rejected", client.Subject.CommonName)
+	return fmt.Errorf("client certificate is not issued to %s", r.clientName)
+}
@@ -0,0 +1,274 @@
+package notifier
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ValidationError is a config problem at the line of the config file (0 if unknown)
+type ValidationError struct {
+	Line    int
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Line == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	lines := make([]string, 0, len(e))
+	for _, err := range e {
+		lines = append(lines, err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+var (
+	yamlErrorLine  = regexp.MustCompile(`^line (\d+): (.*)$`)
+	yamlUnknownKey = regexp.MustCompile(`^field (\S+) not found in type .*$`)
+)
+
+// LoadConfig decodes config rejecting unknown keys, applies environment overrides and validates it,
+// all problems are returned as ValidationErrors
+func LoadConfig(data []byte, config *Config) error {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return ValidationErrors{yamlError(err)}
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	problems := make(ValidationErrors, 0)
+	err := decoder.Decode(config)
+	if err != nil && !errors.Is(err, io.EOF) {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return ValidationErrors{yamlError(err)}
+		}
+		// the rest of the config is decoded, so it is checked too
+		for _, message := range typeErr.Errors {
+			problems = append(problems, yamlError(errors.New(message)))
+		}
+	}
+	problems = append(problems, config.applyEnv(os.LookupEnv)...)
+	config.migrate()
+	problems = append(problems, config.validate(&root)...)
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+func yamlError(err error) ValidationError {
+	message := strings.TrimPrefix(err.Error(), "yaml: ")
+	if match := yamlErrorLine.FindStringSubmatch(message); match != nil {
+		line, _ := strconv.Atoi(match[1])
+		return ValidationError{Line: line, Message: yamlUnknownKey.ReplaceAllString(match[2], "unknown key $1")}
+	}
+	return ValidationError{Message: message}
+}
+
+// configNode helps to find lines of config values
+type configNode struct {
+	*yaml.Node
+}
+
+// get returns value of the mapping key, empty node if missing
+func (n configNode) get(key string) configNode {
+	if n.Node != nil && n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		return configNode{n.Content[0]}.get(key)
+	}
+	if n.Node == nil || n.Kind != yaml.MappingNode {
+		return configNode{}
+	}
+	for idx := 0; idx+1 < len(n.Content); idx += 2 {
+		if n.Content[idx].Value == key {
+			return configNode{n.Content[idx+1]}
+		}
+	}
+	return configNode{}
+}
+
+func (n configNode) item(idx int) configNode {
+	if n.Node == nil || n.Kind != yaml.SequenceNode || idx >= len(n.Content) {
+		return configNode{}
+	}
+	return configNode{n.Content[idx]}
+}
+
+// line of the node, or of the parent when the node is missing
+func (n configNode) line(parent configNode) int {
+	if n.Node != nil {
+		return n.Line
+	}
+	if parent.Node != nil {
+		return parent.Line
+	}
+	return 0
+}
+
+func (c *Config) validate(root *yaml.Node) ValidationErrors {
+	problems := make(ValidationErrors, 0)
+	report := func(line int, format string, args ...interface{}) {
+		problems = append(problems, ValidationError{Line: line, Message: fmt.Sprintf(format, args...)})
+	}
+	doc := configNode{root}
+	telegram := doc.get("telegram")
+
+	if strings.TrimSpace(c.Telegram.BotApi) == "" {
+		report(telegram.get("bot-api").line(telegram), "telegram.bot-api: bot token is empty, set it or %s", EnvName("telegram.bot-api"))
+	}
+	if c.Telegram.ChannelChatId >= 0 {
+		report(telegram.get("channel-chat-id").line(telegram),
+			"telegram.channel-chat-id: %d must be negative (groups and channels have negative ids)", c.Telegram.ChannelChatId)
+	}
+	if c.Telegram.AdminChatId == 0 {
+		report(telegram.get("admin-chat-id").line(telegram), "telegram.admin-chat-id is not set")
+	}
+	if c.Telegram.ThreadId < 0 {
+		report(telegram.get("thread-id").line(telegram), "telegram.thread-id: %d must not be negative", c.Telegram.ThreadId)
+	}
+	switch c.Telegram.ParseMode {
+	case "", ParseModeHTML, ParseModeMarkdownV2:
+	default:
+		report(telegram.get("parse-mode").line(telegram),
+			"telegram.parse-mode: %q must be %s or %s", c.Telegram.ParseMode, ParseModeHTML, ParseModeMarkdownV2)
+	}
+
+	if path, err := url.Parse(c.WebHookPath); !strings.HasPrefix(c.WebHookPath, "/") || err != nil ||
+		path.Path != c.WebHookPath || strings.ContainsAny(c.WebHookPath, " \t") {
+		report(doc.get("web-hook-path").line(doc), "web-hook-path: %q must be an url path like /webhook", c.WebHookPath)
+	}
+
+	if listen := doc.get("web-hook-listen"); c.WebHookListen == "" {
+		report(listen.line(doc), "web-hook-listen is not set, set [host]:port to listen on, e.g. :7777")
+	} else if _, port, err := net.SplitHostPort(listenAddress(c.WebHookListen)); err != nil || port == "" {
+		report(listen.line(doc), "web-hook-listen: %q must be [host]:port", c.WebHookListen)
+	}
+
+	if c.WebHookMaxBodySize < 0 {
+		report(doc.get("web-hook-max-body-size").line(doc), "web-hook-max-body-size: %d must not be negative", c.WebHookMaxBodySize)
+	}
+	if c.WebHookReadTimeout < 0 {
+		report(doc.get("web-hook-read-timeout").line(doc), "web-hook-read-timeout: %s must not be negative", c.WebHookReadTimeout)
+	}
+	if c.WebHookWriteTimeout < 0 {
+		report(doc.get("web-hook-write-timeout").line(doc), "web-hook-write-timeout: %s must not be negative", c.WebHookWriteTimeout)
+	}
+
+	reviewers := doc.get("reviewers")
+	declared := make(map[string]int)
+	for idx, reviewer := range c.Reviewers {
+		line := reviewers.item(idx).line(reviewers)
+		if first, ok := declared[reviewer.Key()]; ok {
+			report(line, "reviewers: %s is already declared at line %d", reviewer.Key(), first)
+			continue
+		}
+		declared[reviewer.Key()] = line
+	}
+
+	projects := doc.get("projects")
+	seen := make(map[string]int)
+	for idx, project := range c.Projects {
+		node := projects.item(idx)
+		line := node.get("project").line(node)
+		if project.Project == "" {
+			report(line, "projects: project url is empty")
+		} else if first, ok := seen[project.Project]; ok {
+			report(line, "projects: %s is already declared at line %d", project.Project, first)
+		} else {
+			seen[project.Project] = line
+		}
+		actions := node.get("actions")
+		for aidx, action := range project.Actions {
+			if !hasAction(DefaultActions, action) {
+				report(actions.item(aidx).line(actions),
+					"projects: unknown action %q of %s, expected one of %s", action, project.Project, strings.Join(DefaultActions, ", "))
+			}
+		}
+	}
+
+	admins := doc.get("admins")
+	users := make(map[int64]int)
+	for idx, admin := range c.Admins {
+		node := admins.item(idx)
+		line := node.get("user-id").line(node)
+		if admin.UserId <= 0 {
+			report(line, "admins: user-id %d must be a positive telegram user id", admin.UserId)
+		} else if first, ok := users[admin.UserId]; ok {
+			report(line, "admins: %d is already declared at line %d", admin.UserId, first)
+		} else {
+			users[admin.UserId] = line
+		}
+		switch admin.Role {
+		case RoleOwner, RoleMaintainer, RoleViewer:
+		default:
+			report(node.get("role").line(node), "admins: unknown role %q of %d, expected one of %s",
+				admin.Role, admin.UserId, strings.Join(roles, ", "))
+		}
+		adminProjects := node.get("projects")
+		for pidx, project := range admin.Projects {
+			if _, ok := seen[project]; !ok {
+				report(adminProjects.item(pidx).line(adminProjects), "admins: project %s of %d is not declared in projects", project, admin.UserId)
+			}
+		}
+	}
+	return problems
+}
+
+// Warnings reports valid but risky settings: project reviewers added to reviewers on load,
+// webhooks accepted without X-Gitlab-Token and projects whose webhooks are rejected because only other projects have secrets
+func (c *Config) Warnings(data []byte) ValidationErrors {
+	warnings := make(ValidationErrors, 0)
+	var root yaml.Node
+	_ = yaml.Unmarshal(data, &root)
+	doc := configNode{&root}
+	projects := doc.get("projects")
+	for _, at := range c.undeclared {
+		node := projects.item(at[0]).get("reviewers")
+		project := c.Projects[at[0]]
+		warnings = append(warnings, ValidationError{
+			Line: node.item(at[1]).line(node),
+			Message: fmt.Sprintf("projects: reviewer %s of %s is not declared in reviewers, it is added there",
+				project.Reviewers[at[1]], project.Project),
+		})
+	}
+	if c.WebHookSecret != "" {
+		return warnings
+	}
+	secured := false
+	for _, project := range c.Projects {
+		secured = secured || project.Secret != ""
+	}
+	if !secured {
+		warnings = append(warnings, ValidationError{
+			Line:    doc.get("web-hook-secret").line(configNode{}),
+			Message: "web-hook-secret is not set: webhooks are accepted from anyone who can reach the listener",
+		})
+	}
+	for idx, project := range c.Projects {
+		if project.Secret != "" {
+			continue
+		}
+		node := projects.item(idx)
+		message := fmt.Sprintf("projects: %s has no secret, its webhooks are accepted without X-Gitlab-Token", project.Project)
+		if secured {
+			message = fmt.Sprintf("projects: %s has no secret and web-hook-secret is not set, its webhooks are rejected", project.Project)
+		}
+		warnings = append(warnings, ValidationError{Line: node.get("project").line(node), Message: message})
+	}
+	return warnings
+}